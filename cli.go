@@ -0,0 +1,74 @@
+package gofiler
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Main is the entry point for a command line profiler.  It reads
+// whitespace separated OCR tokens from stdin, profiles them with the
+// configuration of the given language and writes the profile as json
+// to stdout.  It returns the exit code of the command.  The arguments
+// must not contain the program name, e.g.:
+//
+//	func main() {
+//		os.Exit(gofiler.Main(os.Args[1:]))
+//	}
+//
+// The following flags are supported:
+//
+//	--exe path        path to the profiler executable (default: profiler)
+//	--backend dir     backend directory with the language configurations
+//	--language lang   language of the tokens
+//	--simple          write the simple output instead of json
+//	--types           profile types
+//	--adaptive        use adaptive profiling
+func Main(args []string) int {
+	return runMain(args, os.Stdin, os.Stdout, os.Stderr)
+}
+
+func runMain(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("gofiler", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	exe := flags.String("exe", "profiler", "path to the profiler executable")
+	backend := flags.String("backend", "", "backend directory with the language configurations")
+	language := flags.String("language", "", "language of the tokens")
+	simple := flags.Bool("simple", false, "write the simple output instead of json")
+	types := flags.Bool("types", false, "profile types")
+	adaptive := flags.Bool("adaptive", false, "use adaptive profiling")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "gofiler: %v\n", err)
+		return 1
+	}
+	lc, err := FindLanguage(*backend, *language)
+	if err != nil {
+		return fail(fmt.Errorf("language %s: %v", *language, err))
+	}
+	var tokens []Token
+	s := bufio.NewScanner(stdin)
+	s.Split(bufio.ScanWords)
+	for s.Scan() {
+		tokens = append(tokens, Token{OCR: s.Text()})
+	}
+	if err := s.Err(); err != nil {
+		return fail(fmt.Errorf("read tokens: %v", err))
+	}
+	p := Profiler{Exe: *exe, Config: lc.Path, Types: *types, Adaptive: *adaptive}
+	ctx := context.Background()
+	if *simple {
+		err = p.RunPipe(ctx, tokens, stdout)
+	} else {
+		err = p.RunWriter(ctx, tokens, stdout)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package gofiler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRunMain(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--exe", "testdata/run_profiler.bash", "--backend", "testdata", "--language", "german"},
+			"testdata/profile.json"},
+		{[]string{"--exe", "testdata/run_profiler_simple_output.bash", "--backend", "testdata", "--language", "German", "--simple"},
+			"testdata/profile.txt"},
+	} {
+		t.Run(tc.want, func(t *testing.T) {
+			want, err := ioutil.ReadFile(tc.want)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			var stdout, stderr bytes.Buffer
+			stdin := strings.NewReader("Waſſer Vnheilfolles\ntheyl\n")
+			if code := runMain(tc.args, stdin, &stdout, &stderr); code != 0 {
+				t.Fatalf("expected exit code %d; got %d: %s", 0, code, stderr.String())
+			}
+			if !bytes.Equal(stdout.Bytes(), want) {
+				t.Fatalf("expected %d bytes; got %d", len(want), stdout.Len())
+			}
+		})
+	}
+}
+
+func TestRunMainErrors(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"--no-such-flag"}, 2},
+		{[]string{"--exe", "testdata/run_profiler.bash", "--backend", "testdata", "--language", "klingon"}, 1},
+		{[]string{"--exe", "testdata/no-such-profiler", "--backend", "testdata", "--language", "german"}, 1},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runMain(tc.args, strings.NewReader("a b c"), &stdout, &stderr); code != tc.want {
+				t.Fatalf("expected exit code %d; got %d", tc.want, code)
+			}
+			if stderr.Len() == 0 {
+				t.Fatalf("expected an error message")
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package gofiler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Gap is the marker that is inserted into aligned strings at the
+// positions of insertions and deletions.
+const Gap = '-'
+
+// Alignment aligns the given OCR token with the suggestion of the
+// candidate.  It returns the two aligned strings, where insertions
+// and deletions are marked with Gap.  The alignment is computed using
+// the rune-aware Levenshtein distance.
+func (c Candidate) Alignment(ocr string) (string, string, error) {
+	if !utf8.ValidString(ocr) || !utf8.ValidString(c.Suggestion) {
+		return "", "", fmt.Errorf("alignment %s/%s: invalid utf8", ocr, c.Suggestion)
+	}
+	a, b := align([]rune(ocr), []rune(c.Suggestion))
+	return a, b, nil
+}
+
+// Apply applies the OCR patterns of the candidate to the given OCR
+// token and returns the resulting string.  The observed part of each
+// pattern is replaced with its true part.  Pattern positions are rune
+// offsets into the corrected string.  Since the profiler works on
+// lower case tokens, patterns match case-insensitively and keep the
+// capitalization of the OCR token.  It returns an error if a pattern
+// does not match the OCR token at its position or if two patterns
+// overlap.
+func (c Candidate) Apply(ocr string) (string, error) {
+	ps := append([]Pattern(nil), c.OCRPatterns...)
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].Pos < ps[j].Pos })
+	rs := []rune(ocr)
+	var res []rune
+	var off int // offset of OCR positions relative to corrected positions
+	for _, p := range ps {
+		obs, repl := []rune(p.Observed()), []rune(p.True())
+		pos := p.Pos + off
+		if p.Pos < len(res) || pos < 0 || pos+len(obs) > len(rs) {
+			return "", fmt.Errorf("apply %s to %s: bad position", p, ocr)
+		}
+		res = append(res, rs[len(res)+off:pos]...)
+		got := rs[pos : pos+len(obs)]
+		if !strings.EqualFold(string(got), p.Observed()) {
+			return "", fmt.Errorf("apply %s to %s: pattern does not match", p, ocr)
+		}
+		if len(got) > 0 && len(repl) > 0 && unicode.IsUpper(got[0]) {
+			repl[0] = unicode.ToUpper(repl[0])
+		}
+		res = append(res, repl...)
+		off += len(obs) - len(repl)
+	}
+	return string(append(res, rs[len(res)+off:]...)), nil
+}
+
+// Retained returns the longest common subsequence of the given OCR
+// token and the suggestion of the candidate, i.e. the characters of
+// the OCR token that are retained in the suggestion.
+func (c Candidate) Retained(ocr string) string {
+	return LCS(ocr, c.Suggestion)
+}
+
+// ClusterSuggestions groups the candidates of the interpretation by
+// the rune-aware Levenshtein distance of their suggestions.  Two
+// candidates belong to the same cluster if their suggestions are
+// within maxDist of each other or if they are connected by a chain of
+// such candidates (single-linkage).  The clusters and their
+// candidates keep the order of the interpretation's candidates.
+func (i Interpretation) ClusterSuggestions(maxDist int) [][]Candidate {
+	rs := make([][]rune, len(i.Candidates))
+	for j, c := range i.Candidates {
+		rs[j] = []rune(c.Suggestion)
+	}
+	cluster := make([]int, len(i.Candidates))
+	for j := range cluster {
+		cluster[j] = -1
+	}
+	var n int
+	for j := range i.Candidates {
+		if cluster[j] != -1 {
+			continue
+		}
+		cluster[j] = n
+		stack := []int{j}
+		for len(stack) > 0 {
+			a := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for b := range i.Candidates {
+				if cluster[b] != -1 {
+					continue
+				}
+				if levenshtein(rs[a], rs[b])[len(rs[a])][len(rs[b])] <= maxDist {
+					cluster[b] = n
+					stack = append(stack, b)
+				}
+			}
+		}
+		n++
+	}
+	ret := make([][]Candidate, n)
+	for j, c := range i.Candidates {
+		ret[cluster[j]] = append(ret[cluster[j]], c)
+	}
+	return ret
+}
+
+// LCS returns the longest common subsequence of the runes of the two
+// strings.
+func LCS(a, b string) string {
+	ra, rb := []rune(a), []rune(b)
+	m := make([][]int, len(ra)+1)
+	for i := range m {
+		m[i] = make([]int, len(rb)+1)
+	}
+	for i := len(ra) - 1; i >= 0; i-- {
+		for j := len(rb) - 1; j >= 0; j-- {
+			if ra[i] == rb[j] {
+				m[i][j] = m[i+1][j+1] + 1
+			} else if m[i+1][j] >= m[i][j+1] {
+				m[i][j] = m[i+1][j]
+			} else {
+				m[i][j] = m[i][j+1]
+			}
+		}
+	}
+	var sb strings.Builder
+	for i, j := 0, 0; i < len(ra) && j < len(rb); {
+		switch {
+		case ra[i] == rb[j]:
+			sb.WriteRune(ra[i])
+			i, j = i+1, j+1
+		case m[i+1][j] >= m[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return sb.String()
+}
+
+// levenshtein returns the Levenshtein distance matrix of the two rune
+// slices.  The matrix has the dimensions (len(a)+1)x(len(b)+1).
+func levenshtein(a, b []rune) [][]int {
+	m := make([][]int, len(a)+1)
+	for i := range m {
+		m[i] = make([]int, len(b)+1)
+		m[i][0] = i
+	}
+	for j := range m[0] {
+		m[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			sub := 1
+			if a[i-1] == b[j-1] {
+				sub = 0
+			}
+			m[i][j] = min3(m[i-1][j-1]+sub, m[i-1][j]+1, m[i][j-1]+1)
+		}
+	}
+	return m
+}
+
+// align aligns the two rune slices by backtracking through their
+// Levenshtein distance matrix.  Substitutions are preferred over
+// deletions and deletions are preferred over insertions.
+func align(a, b []rune) (string, string) {
+	ra, rb := alignRunes(a, b)
+	return gapString(ra), gapString(rb)
+}
+
+// noRune marks the gaps in aligned rune slices.  Since it is not a
+// valid rune, it cannot be confused with any rune of the input.
+const noRune rune = -1
+
+// alignRunes aligns the two rune slices like align, but marks the
+// gaps with noRune.
+func alignRunes(a, b []rune) ([]rune, []rune) {
+	m := levenshtein(a, b)
+	var ra, rb []rune
+	i, j := len(a), len(b)
+	for i > 0 || j > 0 {
+		switch {
+		case i > 0 && j > 0 && m[i][j] == m[i-1][j-1]+subcost(a[i-1], b[j-1]):
+			ra = append(ra, a[i-1])
+			rb = append(rb, b[j-1])
+			i, j = i-1, j-1
+		case i > 0 && m[i][j] == m[i-1][j]+1:
+			ra = append(ra, a[i-1])
+			rb = append(rb, noRune)
+			i--
+		default:
+			ra = append(ra, noRune)
+			rb = append(rb, b[j-1])
+			j--
+		}
+	}
+	return reverse(ra), reverse(rb)
+}
+
+func subcost(a, b rune) int {
+	if a == b {
+		return 0
+	}
+	return 1
+}
+
+func reverse(rs []rune) []rune {
+	for i, j := 0, len(rs)-1; i < j; i, j = i+1, j-1 {
+		rs[i], rs[j] = rs[j], rs[i]
+	}
+	return rs
+}
+
+// gapString converts the aligned runes to a string and replaces the
+// gaps with Gap.
+func gapString(rs []rune) string {
+	var b strings.Builder
+	for _, r := range rs {
+		if r == noRune {
+			r = Gap
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
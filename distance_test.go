@@ -0,0 +1,136 @@
+package gofiler
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCandidateAlignment(t *testing.T) {
+	for _, tc := range []struct {
+		ocr, suggestion  string
+		wantOCR, wantSug string
+	}{
+		{"Waſer", "Waſſer", "Wa-ſer", "Waſſer"},
+		{"Waſſer", "Waſer", "Waſſer", "Wa-ſer"},
+		{"theyl", "theil", "theyl", "theil"},
+		{"Vnheilfoles", "Unheilvolles", "Vnheilfo-les", "Unheilvolles"},
+		{"", "ab", "--", "ab"},
+	} {
+		t.Run(tc.ocr, func(t *testing.T) {
+			c := Candidate{Suggestion: tc.suggestion}
+			ocr, sug, err := c.Alignment(tc.ocr)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if ocr != tc.wantOCR || sug != tc.wantSug {
+				t.Fatalf("expected %s/%s; got %s/%s", tc.wantOCR, tc.wantSug, ocr, sug)
+			}
+		})
+	}
+}
+
+func TestCandidateAlignmentInvalidUTF8(t *testing.T) {
+	c := Candidate{Suggestion: "abc"}
+	if _, _, err := c.Alignment("a\xffc"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestLCS(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, want string
+	}{
+		{"", "", ""},
+		{"abc", "", ""},
+		{"abc", "abc", "abc"},
+		{"Waſſer", "Waſer", "Waſer"},
+		{"Waſſer", "Wasser", "Waer"},
+		{"Vnheilfolles", "Unheilvolles", "nheilolles"},
+		{"Waͤſer", "Wäſer", "Wſer"},
+		{"ūheyl", "unheil", "hel"},
+	} {
+		t.Run(tc.a+"/"+tc.b, func(t *testing.T) {
+			if got := LCS(tc.a, tc.b); got != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCandidateApply(t *testing.T) {
+	for _, tc := range []struct {
+		expr, want string
+		iserr      bool
+	}{
+		{"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=0.5,levDistance=1,dict=dict_modern", "theil", false},
+		{"Waſſer@Waser:{Waser+[]}+ocr[(s:ſſ,2)],voteWeight=0.5,levDistance=1,dict=dict_modern", "Waser", false},
+		{"Vnheilfoles@Unheilvolles:{Unheilvolles+[]}+ocr[(U:V,0)(v:f,6)(l:,9)],voteWeight=0.5,levDistance=1,dict=dict_modern", "Unheilvolles", false},
+		{"Waſſer@Wakker:{Wakker+[]}+ocr[(k:ſ,2)(k:ſ,3)],voteWeight=0.5,levDistance=1,dict=dict_modern", "Wakker", false},
+		{"Waſſer@Waiser:{Waiser+[]}+ocr[(is:ſ,2)(:ſ,4)],voteWeight=0.5,levDistance=1,dict=dict_modern", "Waiser", false},
+		{"Vnheilfolles@Vnnheilvolles:{Vnnheilvolles+[]}+ocr[(n:,2)(v:f,7)],voteWeight=0.5,levDistance=1,dict=dict_modern", "Vnnheilvolles", false},
+		{"theil@theil:{teil+[(t:th,0)]}+ocr[],voteWeight=0.5,levDistance=1,dict=dict_modern", "theil", false},
+		{"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,2)],voteWeight=0.5,levDistance=1,dict=dict_modern", "", true},
+		{"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,5)],voteWeight=0.5,levDistance=1,dict=dict_modern", "", true},
+		{"Waſſer@Wakker:{Wakker+[]}+ocr[(k:ſ,2)(kk:ſſ,2)],voteWeight=0.5,levDistance=1,dict=dict_modern", "", true},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			c, ocr, err := MakeCandidate(tc.expr)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			got, err := c.Apply(ocr)
+			if tc.iserr {
+				if err == nil {
+					t.Fatalf("expected error; got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCandidateRetained(t *testing.T) {
+	c := Candidate{Suggestion: "Waſer"}
+	if got, want := c.Retained("Waſſer"), "Waſer"; got != want {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+}
+
+func TestClusterSuggestions(t *testing.T) {
+	i := Interpretation{Candidates: []Candidate{
+		{Suggestion: "Wasser"},
+		{Suggestion: "Haus"},
+		{Suggestion: "Waſſer"},
+		{Suggestion: "Waſſern"},
+		{Suggestion: "Hauſ"},
+		{Suggestion: "Tisch"},
+	}}
+	for _, tc := range []struct {
+		maxDist int
+		want    string
+	}{
+		{0, "[[Wasser] [Haus] [Waſſer] [Waſſern] [Hauſ] [Tisch]]"},
+		{1, "[[Wasser] [Haus Hauſ] [Waſſer Waſſern] [Tisch]]"},
+		{2, "[[Wasser Waſſer Waſſern] [Haus Hauſ] [Tisch]]"},
+	} {
+		t.Run(fmt.Sprint(tc.maxDist), func(t *testing.T) {
+			var got [][]string
+			for _, cluster := range i.ClusterSuggestions(tc.maxDist) {
+				var sugs []string
+				for _, c := range cluster {
+					sugs = append(sugs, c.Suggestion)
+				}
+				got = append(got, sugs)
+			}
+			if fmt.Sprint(got) != tc.want {
+				t.Fatalf("expected %s; got %v", tc.want, got)
+			}
+		})
+	}
+}
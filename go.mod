@@ -1,3 +1,3 @@
 module github.com/finkf/gofiler
 
-go 1.12
+go 1.13
@@ -0,0 +1,64 @@
+package gofiler
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Index maps the OCR tokens of an indexed profile to the byte offsets
+// of their interpretations.
+type Index map[string]int64
+
+// WriteProfileIndexed writes the interpretations of the profile as a
+// stream of length-prefixed records and returns the index of the
+// records.  Each record consists of the length of the json encoded
+// interpretation as big endian uint32 followed by the encoded
+// interpretation.  The records are written in the order of their OCR
+// tokens.  Use ReadInterpretationAt to read a single interpretation.
+func WriteProfileIndexed(w io.Writer, p Profile) (Index, error) {
+	ocrs := make([]string, 0, len(p))
+	for ocr := range p {
+		ocrs = append(ocrs, ocr)
+	}
+	sort.Strings(ocrs)
+	index := make(Index, len(p))
+	var off int64
+	for _, ocr := range ocrs {
+		data, err := json.Marshal(p[ocr])
+		if err != nil {
+			return nil, fmt.Errorf("write indexed profile: %v", err)
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+		if _, err := w.Write(size[:]); err != nil {
+			return nil, fmt.Errorf("write indexed profile: %v", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("write indexed profile: %v", err)
+		}
+		index[ocr] = off
+		off += int64(len(size) + len(data))
+	}
+	return index, nil
+}
+
+// ReadInterpretationAt reads the interpretation of the record at the
+// given offset of a profile written with WriteProfileIndexed.
+func ReadInterpretationAt(r io.ReaderAt, off int64) (Interpretation, error) {
+	var size [4]byte
+	if _, err := r.ReadAt(size[:], off); err != nil {
+		return Interpretation{}, fmt.Errorf("read interpretation at %d: %v", off, err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := r.ReadAt(data, off+int64(len(size))); err != nil {
+		return Interpretation{}, fmt.Errorf("read interpretation at %d: %v", off, err)
+	}
+	var i Interpretation
+	if err := json.Unmarshal(data, &i); err != nil {
+		return Interpretation{}, fmt.Errorf("read interpretation at %d: %v", off, err)
+	}
+	return i, nil
+}
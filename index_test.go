@@ -0,0 +1,52 @@
+package gofiler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestWriteProfileIndexed(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		var buf bytes.Buffer
+		index, err := WriteProfileIndexed(&buf, profile)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(index) != len(profile) {
+			t.Fatalf("expected %d index entries; got %d", len(profile), len(index))
+		}
+		r := bytes.NewReader(buf.Bytes())
+		for _, ocr := range []string{"Waſſer", "Vnheilfolles", "empty"} {
+			t.Run(ocr, func(t *testing.T) {
+				off, ok := index[ocr]
+				if !ok {
+					t.Fatalf("cannot find %q in index", ocr)
+				}
+				got, err := ReadInterpretationAt(r, off)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if !reflect.DeepEqual(got, profile[ocr]) {
+					t.Fatalf("expected %v; got %v", profile[ocr], got)
+				}
+			})
+		}
+	})
+}
+
+func TestReadInterpretationAtBadOffset(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := WriteProfileIndexed(&buf, Profile{"a": {OCR: "a"}}); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if _, err := ReadInterpretationAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -0,0 +1,65 @@
+package gofiler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// IniConfig holds the settings of a parsed ini file.  It maps the
+// section names to the key value pairs of the sections.  Settings
+// before the first section are put into the section with the empty
+// name.
+type IniConfig map[string]map[string]string
+
+// Get returns the value of the given key in the given section.  It
+// returns false if the key is not set.
+func (c IniConfig) Get(section, key string) (string, bool) {
+	val, ok := c[section][key]
+	return val, ok
+}
+
+// Parse reads and parses the ini file of the language configuration.
+// Empty lines and comment lines starting with `;` or `#` are ignored.
+// Only plain files can be parsed; the virtual paths of configurations
+// in archives (see ListLanguagesTarGz) are not supported.
+func (lc LanguageConfiguration) Parse() (IniConfig, error) {
+	in, err := os.Open(lc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", lc.Path, err)
+	}
+	defer in.Close()
+	config := make(IniConfig)
+	section := ""
+	s := bufio.NewScanner(in)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || line[0] == ';' || line[0] == '#':
+			continue
+		case line[0] == '[':
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("parse %s: line %d: bad section %s", lc.Path, n, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if config[section] == nil {
+				config[section] = make(map[string]string)
+			}
+			continue
+		}
+		pos := strings.IndexByte(line, '=')
+		if pos == -1 {
+			return nil, fmt.Errorf("parse %s: line %d: bad setting %s", lc.Path, n, line)
+		}
+		if config[section] == nil {
+			config[section] = make(map[string]string)
+		}
+		key := strings.TrimSpace(line[:pos])
+		config[section][key] = strings.TrimSpace(line[pos+1:])
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", lc.Path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,63 @@
+package gofiler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLanguageConfigurationParse(t *testing.T) {
+	lc, err := FindLanguage("testdata", "german")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	config, err := lc.Parse()
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	tests := []struct {
+		section, key, want string
+		ok                 bool
+	}{
+		{"global", "patternFile", "german/patterns.txt", true},
+		{"global", "dictionaryWeight", "0.5", true},
+		{"dict_modern", "cascadeRank", "0", true},
+		{"dict_hist", "path", "german/historical.fbdic", true},
+		{"dict_hist", "ocrErrorsMaxNumber", "", false},
+		{"no_such_section", "path", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.section+"."+tc.key, func(t *testing.T) {
+			got, ok := config.Get(tc.section, tc.key)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("expected %q, %t; got %q, %t", tc.want, tc.ok, got, ok)
+			}
+		})
+	}
+	if got := len(config); got != 3 {
+		t.Fatalf("expected %d sections; got %d", 3, got)
+	}
+}
+
+func TestLanguageConfigurationParseErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, content := range []string{"[section\n", "[section]\nno setting\n"} {
+		t.Run(content, func(t *testing.T) {
+			path := filepath.Join(dir, "bad.ini")
+			if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if _, err := (LanguageConfiguration{"bad", path}).Parse(); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+	if _, err := (LanguageConfiguration{"none", "testdata/none.ini"}).Parse(); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
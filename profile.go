@@ -1,24 +1,233 @@
 package gofiler
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Profile maps unkown OCR token in a profiled document to the
 // according interpreations of the profiler.
 type Profile map[string]Interpretation
 
+// WriteJSON writes the profile formatted as json into the given
+// writer.  The OCR tokens are written in sorted order, so the output
+// is deterministic.
+func (p Profile) WriteJSON(w io.Writer) error {
+	// The json encoder sorts the keys of maps.
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		return fmt.Errorf("write profile: %v", err)
+	}
+	return nil
+}
+
+// ReadJSON reads a json formatted profile from the given reader.  A
+// null profile results in an empty profile.  Gzip compressed input is
+// detected by its magic header and decompressed transparently.
+func ReadJSON(r io.Reader) (Profile, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("read profile: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	profile := make(Profile)
+	if err := json.NewDecoder(r).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("read profile: %v", err)
+	}
+	if profile == nil {
+		profile = make(Profile)
+	}
+	return profile, nil
+}
+
+// gzipMagic is the magic header of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ReadProfileFile reads a json formatted profile from the given file
+// (see ReadJSON).
+func ReadProfileFile(path string) (Profile, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read profile: %v", err)
+	}
+	defer in.Close()
+	return ReadJSON(in)
+}
+
+// WriteProfileFile writes the profile formatted as json into the given
+// file (see WriteJSON).  If the path ends with `.gz`, the file is gzip
+// compressed.
+func WriteProfileFile(path string, p Profile) (err error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("write profile: %v", err)
+	}
+	defer func() {
+		if e := out.Close(); e != nil && err == nil {
+			err = fmt.Errorf("write profile: %v", e)
+		}
+	}()
+	if !strings.HasSuffix(path, ".gz") {
+		return p.WriteJSON(out)
+	}
+	gz := gzip.NewWriter(out)
+	if err := p.WriteJSON(gz); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("write profile: %v", err)
+	}
+	return nil
+}
+
+// MergeProfileFiles reads the profiles from the given JSON files and
+// merges them into one profile.  The files are decoded incrementally,
+// so only the merged profile is held in memory.  Interpretations of
+// the same OCR token are merged by summing their N and concatenating
+// their candidates.
+func MergeProfileFiles(paths []string) (Profile, error) {
+	profile := make(Profile)
+	for _, path := range paths {
+		if err := profile.mergeFile(path); err != nil {
+			return nil, fmt.Errorf("merge profile files: %v", err)
+		}
+	}
+	return profile, nil
+}
+
+func (p Profile) mergeFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return decodeProfile(in, func(ocr string, i Interpretation) error {
+		p.add(ocr, i)
+		return nil
+	})
+}
+
+// add merges the given interpretation into the profile.
+func (p Profile) add(ocr string, i Interpretation) {
+	old, ok := p[ocr]
+	if !ok {
+		p[ocr] = i
+		return
+	}
+	old.N += i.N
+	old.Candidates = append(old.Candidates, i.Candidates...)
+	p[ocr] = old
+}
+
+// Merge returns the union of the profile and the given profile, e.g.
+// to combine the profiles of the shards of a document.  Neither
+// profile is modified.  Interpretations of the same OCR token are
+// merged by summing their N and concatenating their candidates, where
+// duplicate candidates (see Candidate.Equal) are only kept once.  The
+// OCR fields of both interpretations should match; if they do not, the
+// OCR field (and the OCR confidence) of the receiver wins unless it is
+// empty.
+func (p Profile) Merge(other Profile) Profile {
+	ret := make(Profile, len(p)+len(other))
+	for ocr, i := range p {
+		ret[ocr] = i.clone()
+	}
+	for ocr, i := range other {
+		old, ok := ret[ocr]
+		if !ok {
+			ret[ocr] = i.clone()
+			continue
+		}
+		old.N += i.N
+		if old.OCR == "" {
+			old.OCR = i.OCR
+			old.OCRConfidence = i.OCRConfidence
+		}
+		var cs []Candidate
+		for _, c := range append(old.Candidates, i.clone().Candidates...) {
+			if !containsCandidate(cs, c) {
+				cs = append(cs, c)
+			}
+		}
+		old.Candidates = cs
+		ret[ocr] = old
+	}
+	return ret
+}
+
+func containsCandidate(cs []Candidate, c Candidate) bool {
+	for _, o := range cs {
+		if o.Equal(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeProfile decodes a JSON encoded profile from the given reader
+// and calls f for each of its interpretations.  The profile is
+// decoded incrementally and never held in memory as a whole.
+func decodeProfile(r io.Reader, f func(string, Interpretation) error) error {
+	d := json.NewDecoder(r)
+	tok, err := d.Token()
+	if err != nil {
+		return fmt.Errorf("cannot decode profile: %v", err)
+	}
+	if tok == nil { // null profile
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("cannot decode profile: unexpected token %v", tok)
+	}
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return fmt.Errorf("cannot decode profile: %v", err)
+		}
+		ocr, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("cannot decode profile: unexpected token %v", tok)
+		}
+		var i Interpretation
+		if err := d.Decode(&i); err != nil {
+			return fmt.Errorf("cannot decode profile: %v", err)
+		}
+		if err := f(ocr, i); err != nil {
+			return err
+		}
+	}
+	if _, err := d.Token(); err != nil {
+		return fmt.Errorf("cannot decode profile: %v", err)
+	}
+	return nil
+}
+
 // GlobalHistPatterns returns all global historical patterns with
-// their according probabilities.
+// their according probabilities.  The probabilities of a pattern that
+// appears in multiple candidates are summed up.
 func (p Profile) GlobalHistPatterns() map[string]float64 {
 	ret := make(map[string]float64)
 	for _, i := range p {
 		for _, c := range i.Candidates {
 			for _, p := range c.HistPatterns {
-				ret[p.Left+":"+p.Right] = p.Prob
+				ret[p.Left+":"+p.Right] += p.Prob
 			}
 		}
 	}
@@ -26,26 +235,888 @@ func (p Profile) GlobalHistPatterns() map[string]float64 {
 }
 
 // GlobalOCRPatterns returns all global ocr error patterns with their
-// according probabilities.
+// according probabilities.  The probabilities of a pattern that
+// appears in multiple candidates are summed up.
 func (p Profile) GlobalOCRPatterns() map[string]float64 {
 	ret := make(map[string]float64)
 	for _, i := range p {
 		for _, c := range i.Candidates {
 			for _, p := range c.OCRPatterns {
-				ret[p.Left+":"+p.Right] = p.Prob
+				ret[p.Left+":"+p.Right] += p.Prob
+			}
+		}
+	}
+	return ret
+}
+
+// CountPatterns counts the occurrences of the historical and OCR
+// patterns in all candidates of the profile.  Repeated patterns of a
+// candidate are counted repeatedly.
+func (p Profile) CountPatterns() (hist, ocr map[string]int) {
+	hist = make(map[string]int)
+	ocr = make(map[string]int)
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			for _, p := range c.HistPatterns {
+				hist[p.Left+":"+p.Right]++
+			}
+			for _, p := range c.OCRPatterns {
+				ocr[p.Left+":"+p.Right]++
+			}
+		}
+	}
+	return hist, ocr
+}
+
+// WeightedHistPatternCounts returns the global historical patterns
+// weighted by the number of occurrences of their tokens.  For each
+// candidate a pattern appears in, the token's N is added to the
+// pattern's count.
+func (p Profile) WeightedHistPatternCounts() map[string]float64 {
+	ret := make(map[string]float64)
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			seen := make(map[string]bool)
+			for _, p := range c.HistPatterns {
+				key := p.Left + ":" + p.Right
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				ret[key] += float64(i.N)
+			}
+		}
+	}
+	return ret
+}
+
+// OCRPatternMass returns the share of each OCR error pattern of the
+// total error mass of the profile.  Each occurrence of a pattern in a
+// candidate contributes the token's N times the candidate's vote
+// weight.  The shares sum up to 1.  If the profile has no error mass
+// at all, an empty map is returned.
+func (p Profile) OCRPatternMass() map[string]float64 {
+	ret := make(map[string]float64)
+	var total float64
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			for _, p := range c.OCRPatterns {
+				mass := float64(i.N) * float64(c.Weight)
+				ret[p.Left+":"+p.Right] += mass
+				total += mass
 			}
 		}
 	}
+	if total == 0 {
+		return make(map[string]float64)
+	}
+	for key := range ret {
+		ret[key] /= total
+	}
+	return ret
+}
+
+// ScoreCorrection estimates how likely the given OCR token is an OCR
+// rendering of the given candidate spelling.  The candidate is
+// aligned with the OCR token and each differing pair of aligned runes
+// is looked up in the global OCR patterns of the profile.  The score is
+// the product of the probabilities of these patterns.  If a pattern
+// appears with different probabilities, the maximum is used.  Only
+// single character patterns are considered and unknown patterns have
+// a probability of 0.  Identical strings have a score of 1.
+func (p Profile) ScoreCorrection(ocr, candidate string) float64 {
+	patterns := make(map[string]float64)
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			for _, pat := range c.OCRPatterns {
+				key := pat.Left + ":" + pat.Right
+				if prob, ok := patterns[key]; !ok || pat.Prob > prob {
+					patterns[key] = pat.Prob
+				}
+			}
+		}
+	}
+	ra, rb := alignRunes([]rune(candidate), []rune(ocr))
+	score := 1.0
+	for i := range ra {
+		if ra[i] == rb[i] {
+			continue
+		}
+		var left, right string
+		if ra[i] != noRune {
+			left = string(ra[i])
+		}
+		if rb[i] != noRune {
+			right = string(rb[i])
+		}
+		score *= patterns[left+":"+right]
+	}
+	return score
+}
+
+// Select returns a new profile that contains only the
+// interpretations of the given OCR tokens.  Tokens that are not part
+// of the profile are ignored.
+func (p Profile) Select(tokens []string) Profile {
+	ret := make(Profile)
+	for _, token := range tokens {
+		if i, ok := p[token]; ok {
+			ret[token] = i
+		}
+	}
+	return ret
+}
+
+// Filter returns a new profile that contains only the interpretations
+// for which pred returns true.
+func (p Profile) Filter(pred func(ocr string, i Interpretation) bool) Profile {
+	ret := make(Profile)
+	for ocr, i := range p {
+		if pred(ocr, i) {
+			ret[ocr] = i
+		}
+	}
+	return ret
+}
+
+// EmptyShard is the shard key of the empty OCR token.
+const EmptyShard rune = 0
+
+// ShardByFirstRune splits the profile into sub-profiles keyed by the
+// first rune of the OCR tokens.  The empty token is put into the
+// EmptyShard.
+func (p Profile) ShardByFirstRune() map[rune]Profile {
+	ret := make(map[rune]Profile)
+	for ocr, i := range p {
+		r := EmptyShard
+		if ocr != "" {
+			r, _ = utf8.DecodeRuneInString(ocr)
+		}
+		if ret[r] == nil {
+			ret[r] = make(Profile)
+		}
+		ret[r][ocr] = i
+	}
+	return ret
+}
+
+// ExclusiveDictCorrections returns the sorted list of OCR tokens
+// whose best candidate stems from the given dictionary and whose best
+// suggestion would change if the dictionary's candidates were removed.
+// Tokens whose best candidate is a self correction are skipped.
+func (p Profile) ExclusiveDictCorrections(dict string) []string {
+	var ret []string
+	for ocr, i := range p {
+		best, ok := i.Best()
+		if !ok || best.Dict != dict || best.IsSelfCorrection(ocr) {
+			continue
+		}
+		var others []Candidate
+		for _, c := range i.Candidates {
+			if c.Dict != dict {
+				others = append(others, c)
+			}
+		}
+		if other, ok := bestCandidate(others); !ok || other.Suggestion != best.Suggestion {
+			ret = append(ret, ocr)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// MissingTokens returns the OCR tokens of the given input tokens that
+// are missing in the profile.  Lexicon entries are ignored.  Each
+// missing token is reported once in the order of the input.
+func (p Profile) MissingTokens(input []Token) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, t := range input {
+		if t.LE != "" || seen[t.OCR] {
+			continue
+		}
+		seen[t.OCR] = true
+		if _, ok := p[t.OCR]; !ok {
+			ret = append(ret, t.OCR)
+		}
+	}
+	return ret
+}
+
+// CandidateRow is a flattened candidate with its OCR token.  The
+// historical and OCR patterns are summarized in their string
+// representation, e.g. `(t:th,0)(i:y,2)`.
+type CandidateRow struct {
+	OCR          string  `db:"ocr"`
+	N            int     `db:"n"`
+	Suggestion   string  `db:"suggestion"`
+	Modern       string  `db:"modern"`
+	Dict         string  `db:"dict"`
+	HistPatterns string  `db:"hist_patterns"`
+	OCRPatterns  string  `db:"ocr_patterns"`
+	Distance     int     `db:"distance"`
+	Weight       float32 `db:"weight"`
+	Frequency    int     `db:"frequency"`
+}
+
+// Rows flattens the profile into a list of candidate rows, suitable
+// for bulk inserts into a database.  The rows are ordered by their OCR
+// tokens; the candidates of a token keep their order.
+// Interpretations without any candidates produce no rows.
+func (p Profile) Rows() []CandidateRow {
+	ocrs := make([]string, 0, len(p))
+	for ocr := range p {
+		ocrs = append(ocrs, ocr)
+	}
+	sort.Strings(ocrs)
+	var rows []CandidateRow
+	for _, ocr := range ocrs {
+		i := p[ocr]
+		for _, c := range i.Candidates {
+			rows = append(rows, CandidateRow{
+				OCR:          ocr,
+				N:            i.N,
+				Suggestion:   c.Suggestion,
+				Modern:       c.Modern,
+				Dict:         c.Dict,
+				HistPatterns: ps2str(c.HistPatterns),
+				OCRPatterns:  ps2str(c.OCRPatterns),
+				Distance:     c.Distance,
+				Weight:       c.Weight,
+				Frequency:    c.Frequency,
+			})
+		}
+	}
+	return rows
+}
+
+// WriteCSV writes the profile as CSV with a header and one row for
+// each candidate.  The columns are the OCR token, N, the suggestion,
+// the modern form, the dictionary, the distance, the vote weight and
+// the historical and OCR patterns.  The rows are sorted by their OCR
+// tokens and then by descending vote weights.
+func (p Profile) WriteCSV(w io.Writer) error {
+	rows := p.Rows()
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].OCR != rows[j].OCR {
+			return rows[i].OCR < rows[j].OCR
+		}
+		return rows[i].Weight > rows[j].Weight
+	})
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"OCR", "N", "Suggestion", "Modern", "Dict", "Distance", "Weight", "HistPatterns", "OCRPatterns"})
+	for _, r := range rows {
+		cw.Write([]string{
+			r.OCR,
+			strconv.Itoa(r.N),
+			r.Suggestion,
+			r.Modern,
+			r.Dict,
+			strconv.Itoa(r.Distance),
+			strconv.FormatFloat(float64(r.Weight), 'g', -1, 32),
+			r.HistPatterns,
+			r.OCRPatterns,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("write csv: %v", err)
+	}
+	return nil
+}
+
+// CandidateJaccard compares the suggestions of the profile with the
+// suggestions of another profile.  It returns the Jaccard similarity
+// of the sets of suggestions for each OCR token.  Tokens that are
+// missing in one of the profiles have a similarity of 0.  Tokens
+// without any candidates in both profiles have a similarity of 1.
+func (p Profile) CandidateJaccard(other Profile) map[string]float64 {
+	ret := make(map[string]float64)
+	for ocr, i := range p {
+		o, ok := other[ocr]
+		if !ok {
+			ret[ocr] = 0
+			continue
+		}
+		ret[ocr] = jaccard(suggestions(i), suggestions(o))
+	}
+	for ocr := range other {
+		if _, ok := p[ocr]; !ok {
+			ret[ocr] = 0
+		}
+	}
+	return ret
+}
+
+func suggestions(i Interpretation) map[string]bool {
+	ret := make(map[string]bool)
+	for _, c := range i.Candidates {
+		ret[c.Suggestion] = true
+	}
+	return ret
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	var n int
+	for s := range a {
+		if b[s] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(a)+len(b)-n)
+}
+
+// ComparisonReport summarizes the differences of two profiles.
+// BestDiffers and CountDiffers hold the sorted OCR tokens whose best
+// suggestions or number of candidates differ.  Agreement is the
+// fraction of all OCR tokens with the same best suggestion.
+type ComparisonReport struct {
+	BestDiffers, CountDiffers []string
+	Agreement                 float64
+}
+
+// CompareRuns compares the two profiles.  The comparison covers the
+// OCR tokens of both profiles.  A token that is missing in one of the
+// profiles has no best suggestion and no candidates there.  The
+// agreement of two empty profiles is 0.
+func CompareRuns(a, b Profile) ComparisonReport {
+	ocrs := make(map[string]bool, len(a))
+	for ocr := range a {
+		ocrs[ocr] = true
+	}
+	for ocr := range b {
+		ocrs[ocr] = true
+	}
+	var ret ComparisonReport
+	for ocr := range ocrs {
+		ba, _ := a[ocr].Best()
+		bb, _ := b[ocr].Best()
+		if ba.Suggestion != bb.Suggestion {
+			ret.BestDiffers = append(ret.BestDiffers, ocr)
+		}
+		if len(a[ocr].Candidates) != len(b[ocr].Candidates) {
+			ret.CountDiffers = append(ret.CountDiffers, ocr)
+		}
+	}
+	sort.Strings(ret.BestDiffers)
+	sort.Strings(ret.CountDiffers)
+	if len(ocrs) > 0 {
+		ret.Agreement = float64(len(ocrs)-len(ret.BestDiffers)) / float64(len(ocrs))
+	}
+	return ret
+}
+
+// DictMeanWeight returns the mean vote weight of the candidates of
+// each dictionary in the profile.
+func (p Profile) DictMeanWeight() map[string]float64 {
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			sums[c.Dict] += float64(c.Weight)
+			counts[c.Dict]++
+		}
+	}
+	for dict, n := range counts {
+		sums[dict] /= float64(n)
+	}
+	return sums
+}
+
+// Correct corrects the given tokens.  For each token the best
+// suggestion with a vote weight of at least minWeight is returned.  If
+// no such suggestion exists, the token's OCR string is returned
+// unchanged.  Lexicon entries are passed through unchanged.
+func (p Profile) Correct(tokens []Token, minWeight float32) []string {
+	return p.CorrectWithConfidence(tokens, minWeight, 0)
+}
+
+// CorrectWithConfidence corrects the given tokens like Correct, but
+// additionally trusts the OCR of tokens with a high OCR confidence.
+// If maxConfidence is greater than zero, tokens whose interpretations
+// have an OCRConfidence of at least maxConfidence are left unchanged.
+// Tokens without an OCR confidence are always corrected.
+func (p Profile) CorrectWithConfidence(tokens []Token, minWeight float32, maxConfidence float64) []string {
+	ret := make([]string, len(tokens))
+	for i, t := range tokens {
+		if t.LE != "" {
+			ret[i] = t.LE
+			continue
+		}
+		ret[i] = t.OCR
+		interp := p[t.OCR]
+		if maxConfidence > 0 && interp.OCRConfidence >= maxConfidence {
+			continue
+		}
+		best, ok := interp.Best()
+		if ok && best.Weight >= minWeight {
+			ret[i] = best.Suggestion
+		}
+	}
+	return ret
+}
+
+// Suggestions maps the OCR tokens of the profile to the suggestions of
+// their best candidates (see Interpretation.Best).  Tokens without any
+// candidates and tokens whose best candidate is a self correction are
+// skipped.
+func (p Profile) Suggestions() map[string]string {
+	ret := make(map[string]string)
+	for ocr, i := range p {
+		if best, ok := i.Best(); ok && !best.IsSelfCorrection(ocr) {
+			ret[ocr] = best.Suggestion
+		}
+	}
+	return ret
+}
+
+// OCRErrorChars counts how often each observed (erroneous) part of
+// the OCR patterns appears in all candidates of the profile.  Patterns
+// with an empty observed part (missing characters) are not counted.
+func (p Profile) OCRErrorChars() map[string]int {
+	ret := make(map[string]int)
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			for _, p := range c.OCRPatterns {
+				if p.Observed() != "" {
+					ret[p.Observed()]++
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// TopNRecall returns the fraction of the tokens in the gold standard
+// whose gold correction is among the n candidates with the highest
+// vote weights.  Gold tokens that are missing in the profile count as
+// misses.  It returns 0 for an empty gold standard or if n is not
+// positive.
+func (p Profile) TopNRecall(gold map[string]string, n int) float64 {
+	if len(gold) == 0 || n <= 0 {
+		return 0
+	}
+	var hits int
+	for ocr, cor := range gold {
+		cands := append([]Candidate(nil), p[ocr].Candidates...)
+		sort.SliceStable(cands, func(i, j int) bool {
+			return cands[i].Weight > cands[j].Weight
+		})
+		if len(cands) > n {
+			cands = cands[:n]
+		}
+		for _, c := range cands {
+			if c.Suggestion == cor {
+				hits++
+				break
+			}
+		}
+	}
+	return float64(hits) / float64(len(gold))
+}
+
+// PatternDOT returns a Graphviz DOT graph of the OCR error patterns of
+// the profile with a probability of at least minProb.  Each edge
+// leads from the true to the observed part of a pattern and is
+// labeled with the pattern's probability.  Empty pattern parts are
+// represented by `ε`.
+func (p Profile) PatternDOT(minProb float64) string {
+	probs := make(map[[2]string]float64)
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			for _, pat := range c.OCRPatterns {
+				key := [2]string{pat.True(), pat.Observed()}
+				if prob, ok := probs[key]; !ok || pat.Prob > prob {
+					probs[key] = pat.Prob
+				}
+			}
+		}
+	}
+	var keys [][2]string
+	for key, prob := range probs {
+		if prob >= minProb {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	node := func(str string) string {
+		if str == "" {
+			return `"ε"`
+		}
+		return strconv.Quote(str)
+	}
+	var b strings.Builder
+	b.WriteString("digraph patterns {\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\t%s -> %s [label=\"%g\"];\n",
+			node(key[0]), node(key[1]), probs[key])
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// SuggestionDiversity returns the number of distinct suggestions
+// divided by the number of interpretations in the profile.  It
+// returns 0 for an empty profile.
+func (p Profile) SuggestionDiversity() float64 {
+	if len(p) == 0 {
+		return 0
+	}
+	return float64(p.SuggestionTrie().Len()) / float64(len(p))
+}
+
+// ProfileStats holds summary statistics of a profile.
+type ProfileStats struct {
+	Tokens               int     // Number of (distinct) OCR tokens
+	NoCandidates         int     // Number of tokens without candidates
+	AvgCandidates        float64 // Average number of candidates per token
+	Dicts                int     // Number of distinct dictionaries
+	DistinctHistPatterns int     // Number of distinct historical patterns
+	DistinctOCRPatterns  int     // Number of distinct OCR patterns
+}
+
+// Stats returns the summary statistics of the profile.  Patterns are
+// distinguished by their left and right parts regardless of their
+// positions.  The average number of candidates is 0 for an empty
+// profile.
+func (p Profile) Stats() ProfileStats {
+	var stats ProfileStats
+	var ncands int
+	dicts := make(map[string]bool)
+	hist := make(map[string]bool)
+	ocr := make(map[string]bool)
+	for _, i := range p {
+		stats.Tokens++
+		if len(i.Candidates) == 0 {
+			stats.NoCandidates++
+		}
+		ncands += len(i.Candidates)
+		for _, c := range i.Candidates {
+			dicts[c.Dict] = true
+			for _, p := range c.HistPatterns {
+				hist[p.Left+":"+p.Right] = true
+			}
+			for _, p := range c.OCRPatterns {
+				ocr[p.Left+":"+p.Right] = true
+			}
+		}
+	}
+	if stats.Tokens > 0 {
+		stats.AvgCandidates = float64(ncands) / float64(stats.Tokens)
+	}
+	stats.Dicts = len(dicts)
+	stats.DistinctHistPatterns = len(hist)
+	stats.DistinctOCRPatterns = len(ocr)
+	return stats
+}
+
+// UnknownRate returns the fraction of interpretations whose best
+// candidate is not a lexicon match, i.e. a candidate with a distance
+// of 0 and without any patterns.  Interpretations without candidates
+// count as unknown.  It returns 0 for an empty profile.
+func (p Profile) UnknownRate() float64 {
+	if len(p) == 0 {
+		return 0
+	}
+	var n int
+	for _, i := range p {
+		best, ok := i.Best()
+		if !ok || best.Distance != 0 || len(best.HistPatterns) != 0 || len(best.OCRPatterns) != 0 {
+			n++
+		}
+	}
+	return float64(n) / float64(len(p))
+}
+
+// SuggestionSet is a set of correction suggestions.
+type SuggestionSet struct {
+	set map[string]struct{}
+}
+
+// SuggestionTrie returns the set of all distinct suggestions of all
+// candidates in the profile.
+func (p Profile) SuggestionTrie() *SuggestionSet {
+	set := make(map[string]struct{})
+	for _, i := range p {
+		for _, c := range i.Candidates {
+			set[c.Suggestion] = struct{}{}
+		}
+	}
+	return &SuggestionSet{set: set}
+}
+
+// Contains returns true if the given word is one of the suggestions
+// in the set.
+func (s *SuggestionSet) Contains(word string) bool {
+	_, ok := s.set[word]
+	return ok
+}
+
+// Len returns the number of distinct suggestions in the set.
+func (s *SuggestionSet) Len() int {
+	return len(s.set)
+}
+
+// SuggestionTracker tracks the best suggestions of OCR tokens across
+// a sequence of profiles, e.g. from successive adaptive runs.
+type SuggestionTracker struct {
+	best    map[string]string
+	changes map[string]int
+}
+
+// Update updates the tracker with the next profile in the sequence.
+// Interpretations without any candidates are ignored.
+func (t *SuggestionTracker) Update(p Profile) {
+	if t.best == nil {
+		t.best = make(map[string]string)
+		t.changes = make(map[string]int)
+	}
+	for ocr, i := range p {
+		best, ok := i.Best()
+		if !ok {
+			continue
+		}
+		old, ok := t.best[ocr]
+		if !ok {
+			t.changes[ocr] = 0
+		} else if old != best.Suggestion {
+			t.changes[ocr]++
+		}
+		t.best[ocr] = best.Suggestion
+	}
+}
+
+// Changes returns how many times the best suggestion of each tracked
+// OCR token changed.
+func (t *SuggestionTracker) Changes() map[string]int {
+	ret := make(map[string]int, len(t.changes))
+	for ocr, n := range t.changes {
+		ret[ocr] = n
+	}
+	return ret
+}
+
+// ProfileWithOffsets maps OCR tokens to their interpretations and to
+// the offsets of the tokens in the source document.
+type ProfileWithOffsets map[string]InterpretationWithOffsets
+
+// InterpretationWithOffsets is an interpretation with the sorted list
+// of offsets of all occurrences of its OCR token in the source
+// document.
+type InterpretationWithOffsets struct {
+	Interpretation
+	Offsets []int
+}
+
+// WithOffsets associates the interpretations of the profile with the
+// given offsets of the OCR tokens in the source document.
+// Interpretations without any offsets have an empty offset list.
+// Offsets of tokens that are not part of the profile are ignored.
+func (p Profile) WithOffsets(offsets map[string][]int) ProfileWithOffsets {
+	ret := make(ProfileWithOffsets, len(p))
+	for ocr, i := range p {
+		var offs []int
+		if len(offsets[ocr]) > 0 {
+			offs = append(offs, offsets[ocr]...)
+			sort.Ints(offs)
+		}
+		ret[ocr] = InterpretationWithOffsets{Interpretation: i, Offsets: offs}
+	}
+	return ret
+}
+
+// Provenance is the page and line of a token in the source document.
+type Provenance struct {
+	Page, Line int
+}
+
+// ProfileWithProvenance maps OCR tokens to their interpretations and
+// to the provenance of the tokens in the source document.
+type ProfileWithProvenance map[string]InterpretationWithProvenance
+
+// InterpretationWithProvenance is an interpretation with the
+// provenance of all occurrences of its OCR token in the source
+// document.
+type InterpretationWithProvenance struct {
+	Interpretation
+	Provenance []Provenance
+}
+
+// WithProvenance associates the interpretations of the profile with
+// the pages and lines of the given tokens.  An OCR token that appears
+// multiple times gets the provenance of all its occurrences in the
+// order of the tokens.  Lexicon entries and tokens that are not part
+// of the profile are ignored.
+func (p Profile) WithProvenance(tokens []Token) ProfileWithProvenance {
+	ret := make(ProfileWithProvenance, len(p))
+	for ocr, i := range p {
+		ret[ocr] = InterpretationWithProvenance{Interpretation: i}
+	}
+	for _, t := range tokens {
+		i, ok := ret[t.OCR]
+		if t.LE != "" || !ok {
+			continue
+		}
+		i.Provenance = append(i.Provenance, Provenance{Page: t.Page, Line: t.Line})
+		ret[t.OCR] = i
+	}
 	return ret
 }
 
 // Interpretation holds the list of candiates for OCR tokens.  In the
 // case of lexicon entries, an interpretation holds only one candidate
 // with empty historical and and ocr pattern list.
+//
+// OCRConfidence is the mean glyph confidence of the OCR token.  It is
+// only set if the profiler was run with glyph confidences and is zero
+// otherwise.  See Profile.CorrectWithConfidence to skip the
+// correction of tokens with a high OCR confidence.
 type Interpretation struct {
-	OCR        string
-	N          int
-	Candidates []Candidate
+	OCR           string
+	N             int
+	Candidates    []Candidate
+	OCRConfidence float64
+}
+
+// Entropy returns the Shannon entropy (in bits) of the distribution of
+// the normalized vote weights of the interpretation's candidates.
+// Interpretations with less than two candidates have an entropy of 0.
+// If all candidates have a weight of zero, they are treated as
+// uniformly distributed.
+func (i Interpretation) Entropy() float64 {
+	if len(i.Candidates) < 2 {
+		return 0
+	}
+	var sum float64
+	for _, c := range i.Candidates {
+		sum += float64(c.Weight)
+	}
+	if sum <= 0 {
+		return math.Log2(float64(len(i.Candidates)))
+	}
+	var h float64
+	for _, c := range i.Candidates {
+		if c.Weight <= 0 {
+			continue
+		}
+		p := float64(c.Weight) / sum
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// Probabilities maps the suggestions of the interpretation's
+// candidates to their vote weights normalized to sum to 1.  The
+// weights of candidates with the same suggestion are added.  If all
+// candidates have a weight of zero, a uniform distribution over the
+// candidates is returned.
+func (i Interpretation) Probabilities() map[string]float64 {
+	ret := make(map[string]float64)
+	var sum float64
+	for _, c := range i.Candidates {
+		sum += float64(c.Weight)
+	}
+	for _, c := range i.Candidates {
+		if sum <= 0 {
+			ret[c.Suggestion] += 1 / float64(len(i.Candidates))
+			continue
+		}
+		ret[c.Suggestion] += float64(c.Weight) / sum
+	}
+	return ret
+}
+
+// Consensus returns the suggestion that is supported by the most
+// distinct dictionaries together with the number of these
+// dictionaries.  Ties are broken by the lexicographically smaller
+// suggestion.  It returns an empty suggestion and 0 if the
+// interpretation has no candidates.
+func (i Interpretation) Consensus() (string, int) {
+	dicts := make(map[string]map[string]bool)
+	for _, c := range i.Candidates {
+		if dicts[c.Suggestion] == nil {
+			dicts[c.Suggestion] = make(map[string]bool)
+		}
+		dicts[c.Suggestion][c.Dict] = true
+	}
+	var best string
+	var n int
+	for s, ds := range dicts {
+		if len(ds) > n || (len(ds) == n && s < best) {
+			best, n = s, len(ds)
+		}
+	}
+	return best, n
+}
+
+// CandidatesAtPosition returns the candidates with a historical or OCR
+// pattern that covers the character at the given position.  A pattern
+// covers the characters of its observed part starting at its position;
+// patterns with an empty observed part cover their position only.
+func (i Interpretation) CandidatesAtPosition(pos int) []Candidate {
+	var ret []Candidate
+	for _, c := range i.Candidates {
+		if covers(c.HistPatterns, pos) || covers(c.OCRPatterns, pos) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// clone returns a deep copy of the interpretation.
+func (i Interpretation) clone() Interpretation {
+	if i.Candidates == nil {
+		return i
+	}
+	cs := make([]Candidate, len(i.Candidates))
+	for j, c := range i.Candidates {
+		c.HistPatterns = append([]Pattern(nil), c.HistPatterns...)
+		c.OCRPatterns = append([]Pattern(nil), c.OCRPatterns...)
+		cs[j] = c
+	}
+	i.Candidates = cs
+	return i
+}
+
+// dropPatterns removes all patterns with a probability lower than
+// min from the candidates of the interpretation.
+func (i Interpretation) dropPatterns(min float64) {
+	for j := range i.Candidates {
+		c := &i.Candidates[j]
+		c.HistPatterns = filterPatterns(c.HistPatterns, min)
+		c.OCRPatterns = filterPatterns(c.OCRPatterns, min)
+	}
+}
+
+// filterPatterns returns the patterns with a probability of at least
+// min.  The returned slice does not share the backing array of ps, so
+// the dropped patterns can be garbage collected.  It returns nil if no
+// pattern is kept.
+func filterPatterns(ps []Pattern, min float64) []Pattern {
+	var n int
+	for _, p := range ps {
+		if p.Prob >= min {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	ret := make([]Pattern, 0, n)
+	for _, p := range ps {
+		if p.Prob >= min {
+			ret = append(ret, p)
+		}
+	}
+	return ret
 }
 
 // Candidate represents a correction candidate for an OCR token.
@@ -57,33 +1128,107 @@ type Candidate struct {
 	OCRPatterns  []Pattern // List of OCR error patterns
 	Distance     int       // Levenshtein distance
 	Weight       float32   // The vote weight of the candidate
+	Frequency    int       // Lexicon frequency of the suggestion
 }
 
+// Best returns the candidate with the highest vote weight.  Ties are
+// broken by the lower distance, then by the higher lexicon frequency
+// and then by the lexicographically smaller suggestion.  It returns
+// false if the interpretation has no candidates.
+func (i Interpretation) Best() (Candidate, bool) {
+	return bestCandidate(i.Candidates)
+}
+
+// SortCandidates sorts the candidates of the interpretation by their
+// vote weights in descending order.  Ties are broken by the lower
+// distance.  The sort is stable.
+func (i *Interpretation) SortCandidates() {
+	sort.SliceStable(i.Candidates, func(a, b int) bool {
+		ca, cb := i.Candidates[a], i.Candidates[b]
+		if ca.Weight != cb.Weight {
+			return ca.Weight > cb.Weight
+		}
+		return ca.Distance < cb.Distance
+	})
+}
+
+// bestCandidate returns the best candidate of the list (see
+// Interpretation.Best).  It returns false if the list of candidates
+// is empty.
+func bestCandidate(cs []Candidate) (Candidate, bool) {
+	if len(cs) == 0 {
+		return Candidate{}, false
+	}
+	best := cs[0]
+	for _, c := range cs[1:] {
+		if better(c, best) {
+			best = c
+		}
+	}
+	return best, true
+}
+
+// better returns true if the candidate a is better than b.
+func better(a, b Candidate) bool {
+	switch {
+	case a.Weight != b.Weight:
+		return a.Weight > b.Weight
+	case a.Distance != b.Distance:
+		return a.Distance < b.Distance
+	case a.Frequency != b.Frequency:
+		return a.Frequency > b.Frequency
+	default:
+		return a.Suggestion < b.Suggestion
+	}
+}
+
+// Regular expressions used to parse candidate and pattern expressions.
+var (
+	candidateRE = regexp.MustCompile(`(.*)@(.*):\{(?:(.*)\+\[(.*)\])?\}\+ocr\[(.*)\][,;]voteWeight=(.*)[,;]levDistance=(\d*)(?:[,;]dict=(.*?))?(?:[,;]freq=(\d+))?$`)
+	patternsRE  = regexp.MustCompile(`((\([^)]*\)))`)
+	patternRE   = regexp.MustCompile(`\((.*):(.*?),(\d*)(?:,([^,)]*))?\)`)
+)
+
 // theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=0.749764,levDistance=1,dict=dict_modern_hypothetic_error
+//
+// An optional lexicon frequency `,freq=N` may follow the dictionary.
+// The dictionary may be missing, in which case Dict is left empty, and
+// the modern form and both pattern lists may be empty; the group of
+// the modern form and its historical patterns may also be given as an
+// empty `{}`.
+//
+// Profilers running in a decimal comma locale separate the fields with
+// `;` and use a decimal comma for the vote weight; both variants are
+// accepted.  Errors are returned as *ParseError.
 func MakeCandidate(expr string) (Candidate, string, error) {
-	var re = regexp.MustCompile(`(.*)@(.*):\{(.*)\+\[(.*)\]\}\+ocr\[(.*)\],voteWeight=(.*),levDistance=(\d*),dict=(.*)`)
-	fail := func(err error) (Candidate, string, error) {
-		return Candidate{}, "", fmt.Errorf("make candidate: %v", err)
+	fail := func(field string, err error) (Candidate, string, error) {
+		return Candidate{}, "", &ParseError{Expr: expr, Field: field, Err: err}
 	}
-	m := re.FindStringSubmatch(expr)
+	m := candidateRE.FindStringSubmatch(expr)
 	if m == nil {
-		return fail(fmt.Errorf("bad expression %s", expr))
+		return fail("", nil)
 	}
 	dist, err := strconv.Atoi(m[7])
 	if err != nil {
-		return fail(fmt.Errorf("bad expression %s: %v", expr, err))
+		return fail("levDistance", err)
 	}
-	weight, err := strconv.ParseFloat(m[6], 32)
+	weight, err := strconv.ParseFloat(strings.Replace(m[6], ",", ".", 1), 32)
 	if err != nil {
-		return fail(fmt.Errorf("bad expression %s: %v", expr, err))
+		return fail("voteWeight", err)
 	}
 	hpats, err := str2ps(m[4])
 	if err != nil {
-		return fail(fmt.Errorf("bad expression %s: %v", expr, err))
+		return fail("hist patterns", err)
 	}
 	opats, err := str2ps(m[5])
 	if err != nil {
-		return fail(fmt.Errorf("bad expression %s:%v", expr, err))
+		return fail("ocr patterns", err)
+	}
+	var freq int
+	if m[9] != "" {
+		if freq, err = strconv.Atoi(m[9]); err != nil {
+			return fail("freq", err)
+		}
 	}
 	return Candidate{
 		Suggestion:   m[2],
@@ -93,10 +1238,89 @@ func MakeCandidate(expr string) (Candidate, string, error) {
 		Dict:         m[8],
 		HistPatterns: hpats,
 		OCRPatterns:  opats,
+		Frequency:    freq,
 	}, m[1], nil
 }
 
+// ParseError is the error that is returned by MakeCandidate if a
+// candidate expression cannot be parsed.
+type ParseError struct {
+	Expr  string // The candidate expression
+	Field string // The failing field or empty if the expression is malformed
+	Err   error  // The underlying error or nil
+}
+
+func (e *ParseError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("make candidate: bad expression %s", e.Expr)
+	}
+	return fmt.Sprintf("make candidate: bad %s in expression %s: %v", e.Field, e.Expr, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// NormalizedWeight returns the vote weight of the candidate
+// normalized by the relative edit distance to the given OCR token:
+// `Weight / (1 + Distance/len(ocr))`, where len counts the runes of
+// the OCR token.  For an empty OCR token the distance is used as is.
+func (c Candidate) NormalizedWeight(ocr string) float64 {
+	n := utf8.RuneCountInString(ocr)
+	if n == 0 {
+		n = 1
+	}
+	return float64(c.Weight) / (1 + float64(c.Distance)/float64(n))
+}
+
+// Epsilon is the tolerance used by Candidate.Equal to compare vote
+// weights and pattern probabilities.
+const Epsilon = 1e-6
+
+// Equal returns true if the candidate equals the given candidate.
+// Vote weights and pattern probabilities are compared with a
+// tolerance of Epsilon.  Patterns are compared element-wise, so the
+// order of the patterns matters.
+func (c Candidate) Equal(o Candidate) bool {
+	return c.Suggestion == o.Suggestion &&
+		c.Modern == o.Modern &&
+		c.Dict == o.Dict &&
+		c.Distance == o.Distance &&
+		c.Frequency == o.Frequency &&
+		math.Abs(float64(c.Weight)-float64(o.Weight)) <= Epsilon &&
+		patternsEqual(c.HistPatterns, o.HistPatterns) &&
+		patternsEqual(c.OCRPatterns, o.OCRPatterns)
+}
+
+func patternsEqual(a, b []Pattern) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Left != b[i].Left || a[i].Right != b[i].Right || a[i].Pos != b[i].Pos ||
+			math.Abs(a[i].Prob-b[i].Prob) > Epsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSelfCorrection returns true if the suggestion of the candidate
+// equals the given OCR token, i.e. if the candidate would not change
+// the token at all.
+func (c Candidate) IsSelfCorrection(ocr string) bool {
+	return c.Suggestion == ocr
+}
+
 func (c Candidate) String() string {
+	if c.Frequency != 0 {
+		return fmt.Sprintf("%s,freq=%d", c.string(), c.Frequency)
+	}
+	return c.string()
+}
+
+func (c Candidate) string() string {
 	return fmt.Sprintf(
 		"%s:{%s+[%s]}+ocr[%s],voteWeight=%g,levDistance=%d,dict=%s",
 		c.Suggestion,
@@ -118,8 +1342,7 @@ func ps2str(ps []Pattern) string {
 }
 
 func str2ps(expr string) ([]Pattern, error) {
-	var re = regexp.MustCompile(`((\([^)]*\)))`)
-	m := re.FindAllString(expr, -1)
+	m := patternsRE.FindAllString(expr, -1)
 	if m == nil {
 		return nil, nil
 	}
@@ -144,21 +1367,97 @@ type Pattern struct {
 	Pos   int     // Position
 }
 
-// MakePattern creates a pattern from a pattern expression `(left:right,pos)`.
+// MakePattern creates a pattern from a pattern expression
+// `(left:right,pos)` or `(left:right,pos,prob)`.
 func MakePattern(expr string) (Pattern, error) {
-	var re = regexp.MustCompile(`\((.*):(.*),(\d*)\)`)
-	m := re.FindStringSubmatch(expr)
+	m := patternRE.FindStringSubmatch(expr)
 	if m == nil {
 		return Pattern{}, fmt.Errorf("make pattern: bad expression: %s", expr)
 	}
 	pos, _ := strconv.Atoi(m[3])
+	var prob float64
+	if m[4] != "" {
+		var err error
+		if prob, err = strconv.ParseFloat(m[4], 64); err != nil {
+			return Pattern{}, fmt.Errorf("make pattern: bad probability: %s", expr)
+		}
+	}
 	return Pattern{
 		Left:  m[1],
 		Right: m[2],
+		Prob:  prob,
 		Pos:   pos,
 	}, nil
 }
 
+// String returns the pattern expression of the pattern.  The
+// probability is only part of the expression if it is not zero.
 func (p Pattern) String() string {
+	if p.Prob != 0 {
+		return fmt.Sprintf("(%s:%s,%d,%g)", p.Left, p.Right, p.Pos, p.Prob)
+	}
 	return fmt.Sprintf("(%s:%s,%d)", p.Left, p.Right, p.Pos)
 }
+
+// covers returns true if any of the patterns covers the given
+// position.
+func covers(ps []Pattern, pos int) bool {
+	for _, p := range ps {
+		n := utf8.RuneCountInString(p.Observed())
+		if n == 0 {
+			n = 1
+		}
+		if p.Pos <= pos && pos < p.Pos+n {
+			return true
+		}
+	}
+	return false
+}
+
+// True returns the `true` part of the pattern.  For historical
+// patterns this is the modern form, for OCR patterns it is the
+// correct form.
+func (p Pattern) True() string {
+	return p.Left
+}
+
+// Observed returns the observed part of the pattern.  For historical
+// patterns this is the historical spelling, for OCR patterns it is
+// the erroneous OCR form.
+func (p Pattern) Observed() string {
+	return p.Right
+}
+
+// PatternKind distinguishes historical from OCR patterns.
+type PatternKind int
+
+// The different kinds of patterns.
+const (
+	HistPattern PatternKind = iota // Historical spelling variation
+	OCRPattern                     // OCR error
+)
+
+func (k PatternKind) String() string {
+	if k == HistPattern {
+		return "hist"
+	}
+	return "ocr"
+}
+
+// Labels returns the names of the true and the observed parts of
+// patterns of the given kind: modern and historical for historical
+// patterns and correction and ocr for OCR patterns.
+func (k PatternKind) Labels() (string, string) {
+	if k == HistPattern {
+		return "modern", "historical"
+	}
+	return "correction", "ocr"
+}
+
+// Patterns returns the candidate's patterns of the given kind.
+func (c Candidate) Patterns(kind PatternKind) []Pattern {
+	if kind == HistPattern {
+		return c.HistPatterns
+	}
+	return c.OCRPatterns
+}
@@ -1,10 +1,16 @@
 package gofiler
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -50,12 +56,1036 @@ func TestReadProfileFromJSON(t *testing.T) {
 	}
 }
 
+func TestReadOCRConfidenceFromJSON(t *testing.T) {
+	const js = `{"a":{"OCR":"a","OCRConfidence":0.75},"b":{"OCR":"b"}}`
+	tests := []struct {
+		ocr  string
+		want float64
+	}{
+		{"a", 0.75},
+		{"b", 0},
+	}
+	profile := make(Profile)
+	if err := json.NewDecoder(strings.NewReader(js)).Decode(&profile); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	for _, tc := range tests {
+		t.Run(tc.ocr, func(t *testing.T) {
+			if got := profile[tc.ocr].OCRConfidence; got != tc.want {
+				t.Fatalf("expected %f; got %f", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestProfileMerge(t *testing.T) {
+	withOpenProfile(func(r io.Reader) {
+		var profile Profile
+		if err := json.NewDecoder(r).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		vnheil := profile["Vnheilfolles"]
+		a := Profile{
+			"Vnheilfolles": {OCR: "Vnheilfolles", N: 2, Candidates: vnheil.Candidates[:30]},
+			"Waſſer":       profile["Waſſer"],
+		}
+		b := Profile{
+			"Vnheilfolles": {OCR: "Vnheilfolles", N: 3, Candidates: vnheil.Candidates[20:]},
+			"empty":        profile["empty"],
+		}
+		merged := a.Merge(b)
+		if got := len(merged); got != 3 {
+			t.Fatalf("expected %d interpretations; got %d", 3, got)
+		}
+		for _, tc := range []struct {
+			ocr       string
+			n, ncands int
+		}{
+			{"Vnheilfolles", 5, 41},
+			{"Waſſer", 0, 6},
+			{"empty", 0, 0},
+		} {
+			t.Run(tc.ocr, func(t *testing.T) {
+				i := merged[tc.ocr]
+				if i.N != tc.n {
+					t.Fatalf("expected N=%d; got %d", tc.n, i.N)
+				}
+				if got := len(i.Candidates); got != tc.ncands {
+					t.Fatalf("expected %d candidates; got %d", tc.ncands, got)
+				}
+			})
+		}
+		for j, c := range merged["Vnheilfolles"].Candidates {
+			if !c.Equal(vnheil.Candidates[j]) {
+				t.Fatalf("expected %s; got %s", vnheil.Candidates[j], c)
+			}
+		}
+		if a["Vnheilfolles"].N != 2 || len(a["Vnheilfolles"].Candidates) != 30 || len(a) != 2 {
+			t.Fatalf("merge modified its receiver")
+		}
+	})
+}
+
+func TestProfileStats(t *testing.T) {
+	withOpenProfile(func(r io.Reader) {
+		var profile Profile
+		if err := json.NewDecoder(r).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		want := ProfileStats{
+			Tokens:               4,
+			NoCandidates:         2,
+			AvgCandidates:        11.75,
+			Dicts:                2,
+			DistinctHistPatterns: 35,
+			DistinctOCRPatterns:  42,
+		}
+		if got := profile.Stats(); got != want {
+			t.Fatalf("expected %+v; got %+v", want, got)
+		}
+	})
+	if got := (Profile{}).Stats(); got != (ProfileStats{}) {
+		t.Fatalf("expected %+v; got %+v", ProfileStats{}, got)
+	}
+}
+
+func TestMergeProfileFiles(t *testing.T) {
+	profile, err := MergeProfileFiles([]string{
+		"testdata/profile.json",
+		"testdata/profile2.json",
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	tests := []struct {
+		ocr       string
+		n, ncands int
+	}{
+		{"Vnheilfolles", 0, 41},
+		{"Waſſer", 2, 7},
+		{"theyl", 3, 1},
+		{"empty", 0, 0},
+	}
+	if got := len(profile); got != 5 {
+		t.Fatalf("expected %d interpretations; got %d", 5, got)
+	}
+	for _, tc := range tests {
+		t.Run(tc.ocr, func(t *testing.T) {
+			interpretation, ok := profile[tc.ocr]
+			if !ok {
+				t.Fatalf("cannot find %q in profile", tc.ocr)
+			}
+			if interpretation.N != tc.n {
+				t.Fatalf("expected N=%d; got %d", tc.n, interpretation.N)
+			}
+			if got := len(interpretation.Candidates); got != tc.ncands {
+				t.Fatalf("expected %d; got %d", tc.ncands, got)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got := profile.Select([]string{"Waſſer", "empty", "waſſer", "no-such-token"})
+		if len(got) != 2 {
+			t.Fatalf("expected %d interpretations; got %d", 2, len(got))
+		}
+		for _, ocr := range []string{"Waſſer", "empty"} {
+			if _, ok := got[ocr]; !ok {
+				t.Fatalf("cannot find %q in profile", ocr)
+			}
+		}
+	})
+}
+
+func TestExclusiveDictCorrections(t *testing.T) {
+	profile := Profile{
+		// Only dict a provides the best correction.
+		"a": Interpretation{Candidates: []Candidate{
+			{Suggestion: "x", Dict: "a", Weight: 0.8},
+			{Suggestion: "y", Dict: "b", Weight: 0.2},
+		}},
+		// Dict b provides the same correction.
+		"b": Interpretation{Candidates: []Candidate{
+			{Suggestion: "x", Dict: "a", Weight: 0.6},
+			{Suggestion: "x", Dict: "b", Weight: 0.4},
+		}},
+		// Dict b provides the best correction.
+		"c": Interpretation{Candidates: []Candidate{
+			{Suggestion: "x", Dict: "a", Weight: 0.3},
+			{Suggestion: "y", Dict: "b", Weight: 0.7},
+		}},
+		// Only dict a provides any correction.
+		"d": Interpretation{Candidates: []Candidate{
+			{Suggestion: "x", Dict: "a", Weight: 1},
+		}},
+		"e": Interpretation{},
+	}
+	tests := []struct {
+		dict string
+		want []string
+	}{
+		{"a", []string{"a", "d"}},
+		{"b", []string{"c"}},
+		{"c", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.dict, func(t *testing.T) {
+			got := profile.ExclusiveDictCorrections(tc.dict)
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCandidateJaccard(t *testing.T) {
+	mk := func(suggestions ...string) Interpretation {
+		var i Interpretation
+		for _, s := range suggestions {
+			i.Candidates = append(i.Candidates, Candidate{Suggestion: s})
+		}
+		return i
+	}
+	a := Profile{
+		"same":    mk("x", "y"),
+		"half":    mk("x", "y", "z"),
+		"other":   mk("x"),
+		"onlya":   mk("x"),
+		"empty":   mk(),
+		"partial": mk("x", "y", "y"),
+	}
+	b := Profile{
+		"same":    mk("y", "x"),
+		"half":    mk("x", "y", "w"),
+		"other":   mk("y"),
+		"onlyb":   mk("x"),
+		"empty":   mk(),
+		"partial": mk("y"),
+	}
+	want := map[string]float64{
+		"same":    1,
+		"half":    0.5,
+		"other":   0,
+		"onlya":   0,
+		"onlyb":   0,
+		"empty":   1,
+		"partial": 0.5,
+	}
+	got := a.CandidateJaccard(b)
+	if len(got) != len(want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+	for ocr, j := range want {
+		if got[ocr] != j {
+			t.Fatalf("expected %f for %s; got %f", j, ocr, got[ocr])
+		}
+	}
+}
+
+func TestDictMeanWeight(t *testing.T) {
+	profile := Profile{
+		"a": Interpretation{Candidates: []Candidate{
+			{Dict: "modern", Weight: 0.5},
+			{Dict: "historical", Weight: 0.25},
+		}},
+		"b": Interpretation{Candidates: []Candidate{
+			{Dict: "modern", Weight: 0.25},
+			{Dict: "modern", Weight: 0.75},
+		}},
+		"c": Interpretation{},
+	}
+	want := map[string]float64{"modern": 0.5, "historical": 0.25}
+	got := profile.DictMeanWeight()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+	for dict, w := range want {
+		if math.Abs(got[dict]-w) > 1e-6 {
+			t.Fatalf("expected %f for %s; got %f", w, dict, got[dict])
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got := profile.Filter(func(_ string, i Interpretation) bool {
+			return len(i.Candidates) > 0
+		})
+		if len(got) != 2 || len(got["Vnheilfolles"].Candidates) != 41 || len(got["Waſſer"].Candidates) != 6 {
+			t.Fatalf("expected Vnheilfolles and Waſſer; got %v", got)
+		}
+		if len(profile) != 4 {
+			t.Fatalf("expected %d interpretations; got %d", 4, len(profile))
+		}
+	})
+}
+
+func TestSuggestions(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got := profile.Suggestions()
+		want := map[string]string{"Vnheilfolles": "Unheilvolles", "Waſſer": "Waser"}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	})
+}
+
+func TestSuggestionsSkipsSelfCorrections(t *testing.T) {
+	profile := Profile{
+		"wasser": {OCR: "wasser", Candidates: []Candidate{
+			{Suggestion: "wasser", Weight: 0.9, Dict: "modern"},
+			{Suggestion: "waffer", Weight: 0.3, Distance: 2, Dict: "hist"},
+		}},
+		"Wafser": {OCR: "Wafser", Candidates: []Candidate{
+			{Suggestion: "Wafser", Weight: 0.3, Dict: "modern"},
+			{Suggestion: "Waſſer", Weight: 0.5, Distance: 2, Dict: "modern"},
+		}},
+	}
+	got := profile.Suggestions()
+	want := map[string]string{"Wafser": "Waſſer"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+	if got := profile.ExclusiveDictCorrections("modern"); fmt.Sprint(got) != "[Wafser]" {
+		t.Fatalf("expected %v; got %v", []string{"Wafser"}, got)
+	}
+}
+
+func TestShardByFirstRune(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		profile[""] = Interpretation{}
+		profile["Wäſſer"] = Interpretation{OCR: "Wäſſer"}
+		shards := profile.ShardByFirstRune()
+		if got, want := len(shards), 5; got != want {
+			t.Fatalf("expected %d shards; got %d", want, got)
+		}
+		seen := make(map[string]int)
+		for r, shard := range shards {
+			for ocr := range shard {
+				seen[ocr]++
+				want := EmptyShard
+				if ocr != "" {
+					want = []rune(ocr)[0]
+				}
+				if r != want {
+					t.Fatalf("expected %q in shard %q; got %q", ocr, want, r)
+				}
+			}
+		}
+		for ocr := range profile {
+			if seen[ocr] != 1 {
+				t.Fatalf("expected %q in %d shard; got %d", ocr, 1, seen[ocr])
+			}
+		}
+		if got, want := len(shards['W']), 2; got != want {
+			t.Fatalf("expected %d tokens in shard W; got %d", want, got)
+		}
+	})
+}
+
+func TestCompareRuns(t *testing.T) {
+	a := Profile{
+		"same":  {Candidates: []Candidate{{Suggestion: "x", Weight: 0.5}}},
+		"best":  {Candidates: []Candidate{{Suggestion: "x", Weight: 0.5}, {Suggestion: "y", Weight: 0.4}}},
+		"count": {Candidates: []Candidate{{Suggestion: "x", Weight: 0.5}}},
+		"onlyA": {Candidates: []Candidate{{Suggestion: "x", Weight: 0.5}}},
+	}
+	b := Profile{
+		"same":  {Candidates: []Candidate{{Suggestion: "x", Weight: 0.7}}},
+		"best":  {Candidates: []Candidate{{Suggestion: "x", Weight: 0.3}, {Suggestion: "y", Weight: 0.4}}},
+		"count": {Candidates: []Candidate{{Suggestion: "x", Weight: 0.5}, {Suggestion: "z", Weight: 0.1}}},
+	}
+	got := CompareRuns(a, b)
+	want := ComparisonReport{
+		BestDiffers:  []string{"best", "onlyA"},
+		CountDiffers: []string{"count", "onlyA"},
+		Agreement:    0.5,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+	if got := CompareRuns(nil, nil).Agreement; got != 0 {
+		t.Fatalf("expected %f; got %f", 0.0, got)
+	}
+}
+
+func TestWriteReadJSON(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile, err := ReadJSON(in)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		var a, b bytes.Buffer
+		if err := profile.WriteJSON(&a); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := profile.WriteJSON(&b); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if a.String() != b.String() {
+			t.Fatalf("expected deterministic output")
+		}
+		got, err := ReadJSON(&a)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if !reflect.DeepEqual(got, profile) {
+			t.Fatalf("expected %v; got %v", profile, got)
+		}
+	})
+	if _, err := ReadJSON(strings.NewReader("{")); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if p, err := ReadJSON(strings.NewReader("null")); err != nil || p == nil {
+		t.Fatalf("expected an empty profile; got %v, %v", p, err)
+	}
+}
+
+func TestProfileFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	withOpenProfile(func(in io.Reader) {
+		profile, err := ReadJSON(in)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		for _, name := range []string{"profile.json", "profile.json.gz"} {
+			t.Run(name, func(t *testing.T) {
+				path := filepath.Join(dir, name)
+				if err := WriteProfileFile(path, profile); err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if gz := bytes.HasPrefix(data, gzipMagic); gz != strings.HasSuffix(name, ".gz") {
+					t.Fatalf("bad compression: %t", gz)
+				}
+				got, err := ReadProfileFile(path)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if !reflect.DeepEqual(got, profile) {
+					t.Fatalf("expected %v; got %v", profile, got)
+				}
+			})
+		}
+	})
+}
+
+func TestCorrect(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		tokens := []Token{
+			{LE: "Lexicon"},
+			{OCR: "Vnheilfolles"},
+			{OCR: "Waſſer"},
+			{OCR: "empty"},
+			{OCR: "unknown"},
+		}
+		tests := []struct {
+			minWeight float32
+			want      []string
+		}{
+			{0, []string{"Lexicon", "Unheilvolles", "Waser", "empty", "unknown"}},
+			{0.6, []string{"Lexicon", "Unheilvolles", "Waſſer", "empty", "unknown"}},
+			{0.9, []string{"Lexicon", "Vnheilfolles", "Waſſer", "empty", "unknown"}},
+		}
+		for _, tc := range tests {
+			t.Run(fmt.Sprint(tc.minWeight), func(t *testing.T) {
+				got := profile.Correct(tokens, tc.minWeight)
+				if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+					t.Fatalf("expected %v; got %v", tc.want, got)
+				}
+			})
+		}
+	})
+}
+
+func TestCorrectSelfCorrections(t *testing.T) {
+	profile := Profile{
+		"Wafser": {OCR: "Wafser", Candidates: []Candidate{
+			{Suggestion: "Wafser", Weight: 0.3},
+			{Suggestion: "Waſſer", Weight: 0.5, Distance: 2},
+		}},
+		"wasser": {OCR: "wasser", Candidates: []Candidate{
+			{Suggestion: "wasser", Weight: 0.9},
+			{Suggestion: "waffer", Weight: 0.3, Distance: 2},
+		}},
+	}
+	if !profile["Wafser"].Candidates[0].IsSelfCorrection("Wafser") {
+		t.Fatalf("expected a self correction")
+	}
+	if profile["Wafser"].Candidates[1].IsSelfCorrection("Wafser") {
+		t.Fatalf("expected no self correction")
+	}
+	for _, tc := range []struct {
+		ocr, want string
+	}{
+		{"Wafser", "Waſſer"},
+		{"wasser", "wasser"},
+	} {
+		t.Run(tc.ocr, func(t *testing.T) {
+			got := profile.Correct([]Token{{OCR: tc.ocr}}, 0.1)
+			if want := []string{tc.want}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("expected %v; got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestCorrectWithConfidence(t *testing.T) {
+	profile := Profile{
+		"Wafser": {OCR: "Wafser", OCRConfidence: 0.9, Candidates: []Candidate{
+			{Suggestion: "Waſſer", Weight: 0.5, Distance: 2},
+		}},
+		"theyl": {OCR: "theyl", OCRConfidence: 0.4, Candidates: []Candidate{
+			{Suggestion: "theil", Weight: 0.5, Distance: 1},
+		}},
+		"Vnd": {OCR: "Vnd", Candidates: []Candidate{
+			{Suggestion: "Und", Weight: 0.5, Distance: 1},
+		}},
+	}
+	tokens := []Token{{LE: "Lexicon"}, {OCR: "Wafser"}, {OCR: "theyl"}, {OCR: "Vnd"}}
+	for _, tc := range []struct {
+		max  float64
+		want []string
+	}{
+		{0, []string{"Lexicon", "Waſſer", "theil", "Und"}},
+		{0.8, []string{"Lexicon", "Wafser", "theil", "Und"}},
+		{0.4, []string{"Lexicon", "Wafser", "theyl", "Und"}},
+	} {
+		t.Run(fmt.Sprint(tc.max), func(t *testing.T) {
+			got := profile.CorrectWithConfidence(tokens, 0.1, tc.max)
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestOCRErrorChars(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got := profile.Select([]string{"Waſſer"}).OCRErrorChars()
+		want := map[string]int{"ſſ": 3, "ſ": 6}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	})
+}
+
+func TestTopNRecall(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		gold := map[string]string{
+			"Vnheilfolles": "Unheilvolles", // 1st
+			"Waſſer":       "Warer",        // 2nd
+			"empty":        "empty",
+			"missing":      "missing",
+		}
+		tests := []struct {
+			n    int
+			want float64
+		}{
+			{-1, 0},
+			{0, 0},
+			{1, 0.25},
+			{2, 0.5},
+			{100, 0.5},
+		}
+		for _, tc := range tests {
+			t.Run(fmt.Sprint(tc.n), func(t *testing.T) {
+				if got := profile.TopNRecall(gold, tc.n); got != tc.want {
+					t.Fatalf("expected %f; got %f", tc.want, got)
+				}
+			})
+		}
+	})
+}
+
+func TestPatternDOT(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		dot := profile.PatternDOT(0.15)
+		if !strings.HasPrefix(dot, "digraph patterns {\n") || !strings.HasSuffix(dot, "}\n") {
+			t.Fatalf("bad DOT graph: %s", dot)
+		}
+		for _, edge := range []string{
+			`"v" -> "f" [label="0.2"];`,
+		} {
+			if !strings.Contains(dot, edge) {
+				t.Fatalf("expected %s in %s", edge, dot)
+			}
+		}
+		for _, edge := range []string{
+			`"u" -> "v"`,
+			`"s" -> "ſſ"`,
+		} {
+			if strings.Contains(dot, edge) {
+				t.Fatalf("unexpected %s in %s", edge, dot)
+			}
+		}
+		if dot := profile.PatternDOT(0); !strings.Contains(dot, `"ε" -> "ſ" [label="0.1"];`) {
+			t.Fatalf("expected empty pattern in %s", dot)
+		}
+	})
+}
+
+func TestSuggestionDiversity(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// 47 distinct suggestions for 4 interpretations.
+		if got, want := profile.SuggestionDiversity(), 11.75; got != want {
+			t.Fatalf("expected %f; got %f", want, got)
+		}
+		if got := (Profile{}).SuggestionDiversity(); got != 0 {
+			t.Fatalf("expected %f; got %f", 0.0, got)
+		}
+	})
+}
+
+func TestUnknownRate(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got := profile.UnknownRate(); got != 1 {
+			t.Fatalf("expected %f; got %f", 1.0, got)
+		}
+		profile["Wasser"] = Interpretation{Candidates: []Candidate{
+			{Suggestion: "Wasser", Weight: 0.9},
+			{Suggestion: "Waſſer", Weight: 0.1, HistPatterns: []Pattern{{Left: "s", Right: "ſ"}}},
+		}}
+		profile["theil"] = Interpretation{Candidates: []Candidate{
+			{Suggestion: "theil", Weight: 0.9, HistPatterns: []Pattern{{Left: "t", Right: "th"}}},
+		}}
+		// 5 of 6 interpretations are unknown.
+		if got, want := profile.UnknownRate(), 5.0/6.0; got != want {
+			t.Fatalf("expected %f; got %f", want, got)
+		}
+	})
+}
+
+func TestSuggestionTrie(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		set := profile.SuggestionTrie()
+		tests := []struct {
+			word string
+			want bool
+		}{
+			{"Unheilvolles", true},
+			{"Waser", true},
+			{"Wakker", true},
+			{"Waſſer", false},
+			{"", false},
+		}
+		for _, tc := range tests {
+			t.Run(tc.word, func(t *testing.T) {
+				if got := set.Contains(tc.word); got != tc.want {
+					t.Fatalf("expected %t; got %t", tc.want, got)
+				}
+			})
+		}
+		if got := set.Len(); got != 47 {
+			t.Fatalf("expected %d suggestions; got %d", 47, got)
+		}
+	})
+}
+
+func BenchmarkSuggestionTrie(b *testing.B) {
+	var profile Profile
+	withOpenProfile(func(in io.Reader) {
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			b.Fatalf("got error: %v", err)
+		}
+	})
+	set := profile.SuggestionTrie()
+	words := []string{"Unheilvolles", "Waser", "Waſſer", "no-such-word"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Contains(words[i%len(words)])
+	}
+}
+
+func TestSuggestionTracker(t *testing.T) {
+	mk := func(suggestions map[string]string) Profile {
+		p := make(Profile)
+		for ocr, s := range suggestions {
+			var cands []Candidate
+			if s != "" {
+				cands = []Candidate{{Suggestion: s, Weight: 0.9}, {Suggestion: "x", Weight: 0.1}}
+			}
+			p[ocr] = Interpretation{OCR: ocr, Candidates: cands}
+		}
+		return p
+	}
+	var tracker SuggestionTracker
+	for _, p := range []Profile{
+		mk(map[string]string{"a": "a1", "b": "b1"}),
+		mk(map[string]string{"a": "a2", "b": "b1", "c": ""}),
+		mk(map[string]string{"a": "a1", "b": "", "c": "c1"}),
+		mk(map[string]string{"a": "a1", "b": "b1", "c": "c1"}),
+	} {
+		tracker.Update(p)
+	}
+	want := map[string]int{"a": 2, "b": 0, "c": 0}
+	if got := tracker.Changes(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+}
+
+func TestWithOffsets(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got := profile.WithOffsets(map[string][]int{
+			"Waſſer":        {42, 7, 100},
+			"empty":         {13},
+			"no-such-token": {1},
+		})
+		tests := []struct {
+			ocr  string
+			want []int
+		}{
+			{"Waſſer", []int{7, 42, 100}},
+			{"empty", []int{13}},
+			{"Vnheilfolles", nil},
+		}
+		if len(got) != len(profile) {
+			t.Fatalf("expected %d interpretations; got %d", len(profile), len(got))
+		}
+		for _, tc := range tests {
+			t.Run(tc.ocr, func(t *testing.T) {
+				i, ok := got[tc.ocr]
+				if !ok {
+					t.Fatalf("cannot find %q in profile", tc.ocr)
+				}
+				if i.OCR != tc.ocr {
+					t.Fatalf("expected OCR=%q; got %q", tc.ocr, i.OCR)
+				}
+				if fmt.Sprint(i.Offsets) != fmt.Sprint(tc.want) {
+					t.Fatalf("expected %v; got %v", tc.want, i.Offsets)
+				}
+			})
+		}
+	})
+}
+
+func TestInterpretationEntropy(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []float32
+		want    float64
+	}{
+		{"empty", nil, 0},
+		{"single", []float32{0.5}, 0},
+		{"uniform", []float32{0.25, 0.25, 0.25, 0.25}, 2},
+		{"uniform-unnormalized", []float32{2, 2}, 1},
+		{"zero", []float32{0, 0}, 1},
+		{"peaked", []float32{1, 0}, 0},
+		{"skewed", []float32{0.75, 0.25}, 0.811278},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var i Interpretation
+			for _, w := range tc.weights {
+				i.Candidates = append(i.Candidates, Candidate{Weight: w})
+			}
+			if got := i.Entropy(); math.Abs(got-tc.want) > 1e-6 {
+				t.Fatalf("expected %f; got %f", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestInterpretationProbabilities(t *testing.T) {
+	tests := []struct {
+		name  string
+		cands []Candidate
+		want  map[string]float64
+	}{
+		{"empty", nil, map[string]float64{}},
+		{"weights", []Candidate{
+			{Suggestion: "a", Weight: 3},
+			{Suggestion: "b", Weight: 1},
+		}, map[string]float64{"a": 0.75, "b": 0.25}},
+		{"duplicates", []Candidate{
+			{Suggestion: "a", Weight: 0.2},
+			{Suggestion: "b", Weight: 0.4},
+			{Suggestion: "a", Weight: 0.2},
+		}, map[string]float64{"a": 0.5, "b": 0.5}},
+		{"zero", []Candidate{
+			{Suggestion: "a"},
+			{Suggestion: "b"},
+			{Suggestion: "c"},
+			{Suggestion: "d"},
+		}, map[string]float64{"a": 0.25, "b": 0.25, "c": 0.25, "d": 0.25}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Interpretation{Candidates: tc.cands}.Probabilities()
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+			for s, p := range tc.want {
+				if math.Abs(got[s]-p) > 1e-6 {
+					t.Fatalf("expected %v; got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	withOpenProfile(func(r io.Reader) {
+		var profile Profile
+		if err := json.NewDecoder(r).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := profile.WriteCSV(&buf); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		want, err := ioutil.ReadFile("testdata/profile.csv")
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got := buf.String(); got != string(want) {
+			t.Fatalf("expected %s; got %s", want, got)
+		}
+	})
+}
+
+func TestRows(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		rows := profile.Rows()
+		if got := len(rows); got != 47 {
+			t.Fatalf("expected %d rows; got %d", 47, got)
+		}
+		// Vnheilfolles < Waſſer; Waſſer's first candidate is the 42nd row.
+		want := CandidateRow{
+			OCR:          "Waſſer",
+			Suggestion:   "Waser",
+			Modern:       "wasser",
+			Dict:         "dict_guikorpus_errors",
+			HistPatterns: "(ss:s,2,0.1)",
+			OCRPatterns:  "(s:ſſ,2,0.1)",
+			Distance:     2,
+			Weight:       0.499883,
+		}
+		if got := rows[41]; got != want {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	})
+}
+
+func TestInterpretationConsensus(t *testing.T) {
+	tests := []struct {
+		name  string
+		cands []Candidate
+		want  string
+		n     int
+	}{
+		{"empty", nil, "", 0},
+		{"agreement", []Candidate{
+			{Suggestion: "Wasser", Dict: "modern", Weight: 0.1},
+			{Suggestion: "Waser", Dict: "modern", Weight: 0.8},
+			{Suggestion: "Wasser", Dict: "historical", Weight: 0.05},
+			{Suggestion: "Wasser", Dict: "modern", Weight: 0.05},
+			{Suggestion: "Wasser", Dict: "names", Weight: 0.05},
+		}, "Wasser", 3},
+		{"tie", []Candidate{
+			{Suggestion: "b", Dict: "modern"},
+			{Suggestion: "a", Dict: "historical"},
+		}, "a", 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, n := Interpretation{Candidates: tc.cands}.Consensus()
+			if got != tc.want || n != tc.n {
+				t.Fatalf("expected %s, %d; got %s, %d", tc.want, tc.n, got, n)
+			}
+		})
+	}
+}
+
+func TestInterpretationCandidatesAtPosition(t *testing.T) {
+	i := Interpretation{OCR: "theyl", Candidates: []Candidate{
+		{Suggestion: "theil", HistPatterns: []Pattern{{Left: "t", Right: "th", Pos: 0}},
+			OCRPatterns: []Pattern{{Left: "i", Right: "y", Pos: 3}}},
+		{Suggestion: "teil", OCRPatterns: []Pattern{{Left: "", Right: "h", Pos: 1}, {Left: "i", Right: "y", Pos: 2}}},
+		{Suggestion: "theyld", OCRPatterns: []Pattern{{Left: "d", Right: "", Pos: 5}}},
+	}}
+	tests := []struct {
+		pos  int
+		want []string
+	}{
+		{0, []string{"theil"}},
+		{1, []string{"theil", "teil"}},
+		{2, []string{"teil"}},
+		{3, []string{"theil"}},
+		{4, nil},
+		{5, []string{"theyld"}},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprint(tc.pos), func(t *testing.T) {
+			var got []string
+			for _, c := range i.CandidatesAtPosition(tc.pos) {
+				got = append(got, c.Suggestion)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCandidateNormalizedWeight(t *testing.T) {
+	tests := []struct {
+		ocr  string
+		c    Candidate
+		want float64
+	}{
+		{"abc", Candidate{Weight: 0.5}, 0.5},
+		{"abc", Candidate{Weight: 0.5, Distance: 1}, 0.375},
+		{"abcdefghijkl", Candidate{Weight: 0.5, Distance: 1}, 0.461538},
+		{"ſſſſ", Candidate{Weight: 0.5, Distance: 2}, 0.333333},
+		{"", Candidate{Weight: 0.5, Distance: 1}, 0.25},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ocr, func(t *testing.T) {
+			if got := tc.c.NormalizedWeight(tc.ocr); math.Abs(got-tc.want) > 1e-6 {
+				t.Fatalf("expected %f; got %f", tc.want, got)
+			}
+		})
+	}
+	short := Candidate{Weight: 0.5, Distance: 1}.NormalizedWeight("abc")
+	long := Candidate{Weight: 0.5, Distance: 1}.NormalizedWeight("abcdefghijkl")
+	if short >= long {
+		t.Fatalf("expected %f < %f", short, long)
+	}
+}
+
+func TestCandidateEqual(t *testing.T) {
+	c := Candidate{
+		Suggestion:   "Waser",
+		Modern:       "Wasser",
+		Dict:         "dict_modern",
+		HistPatterns: []Pattern{{Left: "ss", Right: "s", Pos: 2, Prob: 0.3}},
+		OCRPatterns:  []Pattern{{Left: "s", Right: "ſ", Pos: 2, Prob: 0.1}, {Left: "e", Right: "c", Pos: 3}},
+		Distance:     2,
+		Weight:       0.75,
+		Frequency:    7,
+	}
+	clone := func() Candidate {
+		return Interpretation{Candidates: []Candidate{c}}.clone().Candidates[0]
+	}
+	drift := clone()
+	drift.Weight += 1e-7
+	drift.OCRPatterns[0].Prob += 1e-7
+	swapped := clone()
+	swapped.OCRPatterns[0], swapped.OCRPatterns[1] = swapped.OCRPatterns[1], swapped.OCRPatterns[0]
+	weight := clone()
+	weight.Weight += 1e-3
+	prob := clone()
+	prob.HistPatterns[0].Prob += 1e-3
+	freq := clone()
+	freq.Frequency++
+	for _, tc := range []struct {
+		name string
+		o    Candidate
+		want bool
+	}{
+		{"equal", clone(), true},
+		{"weight drift within epsilon", drift, true},
+		{"pattern order differs", swapped, false},
+		{"weight differs", weight, false},
+		{"probability differs", prob, false},
+		{"frequency differs", freq, false},
+		{"empty", Candidate{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := c.Equal(tc.o); got != tc.want {
+				t.Fatalf("expected %t; got %t", tc.want, got)
+			}
+			if got := tc.o.Equal(c); got != tc.want {
+				t.Fatalf("expected %t; got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFilterPatterns(t *testing.T) {
+	ps := []Pattern{{"a", "b", 0.1, 0}, {"c", "d", 0.5, 1}, {"e", "f", 0.2, 2}}
+	got := filterPatterns(ps, 0.2)
+	if len(got) != 2 || cap(got) != 2 || got[0].Left != "c" || got[1].Left != "e" {
+		t.Fatalf("expected %v with capacity %d; got %v with capacity %d", ps[1:], 2, got, cap(got))
+	}
+	if ps[0].Left != "a" {
+		t.Fatalf("filterPatterns modified its input: %v", ps)
+	}
+	if got := filterPatterns(ps, 0.6); got != nil {
+		t.Fatalf("expected nil; got %v", got)
+	}
+}
+
 func TestPatternString(t *testing.T) {
 	for _, tc := range []struct {
 		p    Pattern
 		want string
 	}{
 		{Pattern{"a", "b", 0.0, 1}, "(a:b,1)"},
+		{Pattern{"t", "th", 0.0123, 0}, "(t:th,0,0.0123)"},
+		{Pattern{"", "ſ", 1e-05, 2}, "(:ſ,2,1e-05)"},
 	} {
 		t.Run(tc.want, func(t *testing.T) {
 			if got := tc.p.String(); got != tc.want {
@@ -73,7 +1103,7 @@ func TestCandidateString(t *testing.T) {
 		{
 			Candidate{"sug", "modern", "dict",
 				[]Pattern{{"a", "b", 0.0, 1}},
-				[]Pattern{{"c", "d", 0.0, 3}}, 2, 1e-4},
+				[]Pattern{{"c", "d", 0.0, 3}}, 2, 1e-4, 0},
 			"sug:{modern+[(a:b,1)]}+ocr[(c:d,3)],voteWeight=0.0001,levDistance=2,dict=dict",
 		},
 	} {
@@ -92,8 +1122,8 @@ func TestGlobalPatterns(t *testing.T) {
 		ocr  bool
 	}{
 		{"u:v", 0.1, true},
-		{"v:f", 0.2, true},
-		{"un:vn", 0.3, false},
+		{"v:f", 7.1, true},
+		{"un:vn", 5.4, false},
 		{"u:û", 0.4, false},
 	}
 	for _, tc := range tests {
@@ -107,10 +1137,218 @@ func TestGlobalPatterns(t *testing.T) {
 				if tc.ocr {
 					got = profile.GlobalOCRPatterns()[tc.pat]
 				}
+				if math.Abs(got-tc.want) > 1e-9 {
+					t.Fatalf("expected %f; got %f", tc.want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestGlobalPatternsSum(t *testing.T) {
+	profile := Profile{
+		"a": Interpretation{OCR: "a", Candidates: []Candidate{
+			{
+				HistPatterns: []Pattern{{Left: "t", Right: "th", Prob: 0.25}},
+				OCRPatterns:  []Pattern{{Left: "s", Right: "f", Prob: 0.5}},
+			},
+			{
+				HistPatterns: []Pattern{{Left: "t", Right: "th", Prob: 0.25}},
+				OCRPatterns:  []Pattern{{Left: "e", Right: "c", Prob: 0.125}},
+			},
+		}},
+		"b": Interpretation{OCR: "b", Candidates: []Candidate{
+			{OCRPatterns: []Pattern{{Left: "s", Right: "f", Prob: 0.5}}},
+		}},
+	}
+	if got, want := profile.GlobalHistPatterns()["t:th"], 0.5; got != want {
+		t.Fatalf("expected %f; got %f", want, got)
+	}
+	ocr := profile.GlobalOCRPatterns()
+	if got, want := ocr["s:f"], 1.0; got != want {
+		t.Fatalf("expected %f; got %f", want, got)
+	}
+	if got, want := ocr["e:c"], 0.125; got != want {
+		t.Fatalf("expected %f; got %f", want, got)
+	}
+}
+
+func TestCountPatterns(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		hist, ocr := profile.CountPatterns()
+		tests := []struct {
+			pat  string
+			want int
+			ocr  bool
+		}{
+			{"u:v", 19, false},
+			{"un:vn", 18, false},
+			{"v:f", 36, true},
+			{"e:", 3, true},
+			{"x:y", 0, true},
+		}
+		for _, tc := range tests {
+			t.Run(tc.pat, func(t *testing.T) {
+				got := hist[tc.pat]
+				if tc.ocr {
+					got = ocr[tc.pat]
+				}
 				if got != tc.want {
-					t.Fatalf("expected %f; got %f", got, tc.want)
+					t.Fatalf("expected %d; got %d", tc.want, got)
 				}
 			})
+		}
+	})
+	hist, _ := Profile{"a": Interpretation{Candidates: []Candidate{
+		{HistPatterns: []Pattern{{Left: "u", Right: "v"}, {Left: "u", Right: "v", Pos: 3}}},
+	}}}.CountPatterns()
+	if got := hist["u:v"]; got != 2 {
+		t.Fatalf("expected %d; got %d", 2, got)
+	}
+}
+
+func TestOCRPatternMass(t *testing.T) {
+	profile := Profile{
+		"a": Interpretation{OCR: "a", N: 2, Candidates: []Candidate{
+			{Weight: 0.5, OCRPatterns: []Pattern{{Left: "x", Right: "y"}, {Left: "y", Right: "z"}}},
+		}},
+		"b": Interpretation{OCR: "b", N: 1, Candidates: []Candidate{
+			{Weight: 1, OCRPatterns: []Pattern{{Left: "x", Right: "y"}}},
+			{Weight: 0, OCRPatterns: []Pattern{{Left: "u", Right: "v"}}},
+		}},
+	}
+	mass := profile.OCRPatternMass()
+	tests := []struct {
+		pat  string
+		want float64
+	}{
+		{"x:y", 2.0 / 3},
+		{"y:z", 1.0 / 3},
+		{"u:v", 0},
+	}
+	var sum float64
+	for _, tc := range tests {
+		t.Run(tc.pat, func(t *testing.T) {
+			if got := mass[tc.pat]; math.Abs(got-tc.want) > 1e-9 {
+				t.Fatalf("expected %f; got %f", tc.want, got)
+			}
+		})
+		sum += mass[tc.pat]
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Fatalf("expected %f; got %f", 1.0, sum)
+	}
+	if got := len(Profile{}.OCRPatternMass()); got != 0 {
+		t.Fatalf("expected %d patterns; got %d", 0, got)
+	}
+}
+
+func TestScoreCorrection(t *testing.T) {
+	profile := Profile{
+		"a": Interpretation{OCR: "a", Candidates: []Candidate{
+			{OCRPatterns: []Pattern{{Left: "s", Right: "f", Prob: 0.5}, {Left: "e", Right: "c", Prob: 0.2}}},
+		}},
+		"b": Interpretation{OCR: "b", Candidates: []Candidate{
+			{OCRPatterns: []Pattern{{Left: "r", Right: "", Prob: 0.1}, {Left: "", Right: "i", Prob: 0.4}}},
+		}},
+		"c": Interpretation{OCR: "c", Candidates: []Candidate{
+			{OCRPatterns: []Pattern{{Left: "-", Right: "=", Prob: 0.3}, {Left: "-", Right: "", Prob: 0.6}}},
+		}},
+	}
+	tests := []struct {
+		ocr, cand string
+		want      float64
+	}{
+		{"Wasser", "Wasser", 1},
+		{"Waffer", "Wasser", 0.25},
+		{"Waffcr", "Wasser", 0.05},
+		{"Wasse", "Wasser", 0.1},
+		{"Wasseir", "Wasser", 0.4},
+		{"Waxser", "Wasser", 0},
+		{"Waffer-Bad", "Wasser-Bad", 0.25},
+		{"Wasser=Bad", "Wasser-Bad", 0.3},
+		{"WasserBad", "Wasser-Bad", 0.6},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ocr, func(t *testing.T) {
+			if got := profile.ScoreCorrection(tc.ocr, tc.cand); math.Abs(got-tc.want) > 1e-9 {
+				t.Fatalf("expected %f; got %f", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWeightedHistPatternCounts(t *testing.T) {
+	profile := Profile{
+		"a": Interpretation{OCR: "a", N: 10, Candidates: []Candidate{
+			{HistPatterns: []Pattern{{Left: "u", Right: "v"}, {Left: "u", Right: "v"}}},
+			{HistPatterns: []Pattern{{Left: "t", Right: "th"}}},
+		}},
+		"b": Interpretation{OCR: "b", N: 1, Candidates: []Candidate{
+			{HistPatterns: []Pattern{{Left: "u", Right: "v"}}},
+		}},
+		"c": Interpretation{OCR: "c", N: 3, Candidates: []Candidate{
+			{HistPatterns: []Pattern{{Left: "t", Right: "th"}}},
+			{HistPatterns: []Pattern{{Left: "t", Right: "th"}}},
+		}},
+	}
+	tests := []struct {
+		pat  string
+		want float64
+	}{
+		{"u:v", 11},
+		{"t:th", 16},
+		{"x:y", 0},
+	}
+	counts := profile.WeightedHistPatternCounts()
+	for _, tc := range tests {
+		t.Run(tc.pat, func(t *testing.T) {
+			if got := counts[tc.pat]; got != tc.want {
+				t.Fatalf("expected %f; got %f", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPatternKinds(t *testing.T) {
+	// theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)]
+	c := Candidate{
+		Suggestion:   "theil",
+		Modern:       "teil",
+		HistPatterns: []Pattern{{Left: "t", Right: "th", Pos: 0}},
+		OCRPatterns:  []Pattern{{Left: "i", Right: "y", Pos: 3}},
+	}
+	tests := []struct {
+		kind                          PatternKind
+		true, observed                string
+		trueLabel, observedLabel, str string
+	}{
+		{HistPattern, "t", "th", "modern", "historical", "hist"},
+		{OCRPattern, "i", "y", "correction", "ocr", "ocr"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.str, func(t *testing.T) {
+			if got := tc.kind.String(); got != tc.str {
+				t.Fatalf("expected %s; got %s", tc.str, got)
+			}
+			ps := c.Patterns(tc.kind)
+			if len(ps) != 1 {
+				t.Fatalf("expected %d pattern; got %d", 1, len(ps))
+			}
+			if got := ps[0].True(); got != tc.true {
+				t.Fatalf("expected %s; got %s", tc.true, got)
+			}
+			if got := ps[0].Observed(); got != tc.observed {
+				t.Fatalf("expected %s; got %s", tc.observed, got)
+			}
+			tl, ol := tc.kind.Labels()
+			if tl != tc.trueLabel || ol != tc.observedLabel {
+				t.Fatalf("expected %s, %s; got %s, %s", tc.trueLabel, tc.observedLabel, tl, ol)
+			}
 		})
 	}
 }
@@ -118,6 +1356,8 @@ func TestGlobalPatterns(t *testing.T) {
 func TestMakePattern(t *testing.T) {
 	for _, tc := range []struct{ test string }{
 		{"(a:b,1)"},
+		{"(t:th,0,0.0123)"},
+		{"(:ſ,2,1e-05)"},
 	} {
 		t.Run(tc.test, func(t *testing.T) {
 			p, err := MakePattern(tc.test)
@@ -131,9 +1371,34 @@ func TestMakePattern(t *testing.T) {
 	}
 }
 
+func TestMakePatternProb(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want Pattern
+	}{
+		{"(a:b,1)", Pattern{"a", "b", 0.0, 1}},
+		{"(t:th,0,0.0123)", Pattern{"t", "th", 0.0123, 0}},
+		{"(a:b,c,1)", Pattern{"a", "b,c", 0.0, 1}},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			got, err := MakePattern(tc.expr)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+	if _, err := MakePattern("(a:b,1,x)"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
 func TestMakeCandidate(t *testing.T) {
 	for _, tc := range []struct{ test string }{
 		{"theyl@theil:{teil+[(t:th,0)(a:b,3)]}+ocr[(i:y,3)(x:y,4)],voteWeight=0.74,levDistance=1,dict=modern"},
+		{"theyl@theil:{teil+[(t:th,0)(a:b,3)]}+ocr[(i:y,3)(x:y,4)],voteWeight=0.74,levDistance=1,dict=modern,freq=42"},
 	} {
 		t.Run(tc.test, func(t *testing.T) {
 			cand, ocr, err := MakeCandidate(tc.test)
@@ -146,3 +1411,255 @@ func TestMakeCandidate(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeCandidateLenient(t *testing.T) {
+	for _, tc := range []struct {
+		test, sug, modern, dict string
+		nhist, nocr             int
+	}{
+		{"a@b:{+[]}+ocr[(b:a,0)],voteWeight=0.5,levDistance=1,dict=modern", "b", "", "modern", 0, 1},
+		{"a@b:{}+ocr[(b:a,0)],voteWeight=0.5,levDistance=1,dict=modern", "b", "", "modern", 0, 1},
+		{"a@a:{a+[]}+ocr[],voteWeight=0.5,levDistance=0,dict=modern", "a", "a", "modern", 0, 0},
+		{"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=0.5,levDistance=1", "theil", "teil", "", 1, 1},
+		{"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=0.5,levDistance=1,freq=3", "theil", "teil", "", 1, 1},
+		{"a@b:{}+ocr[],voteWeight=0.5,levDistance=1", "b", "", "", 0, 0},
+	} {
+		t.Run(tc.test, func(t *testing.T) {
+			cand, ocr, err := MakeCandidate(tc.test)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if ocr == "" || cand.Suggestion != tc.sug || cand.Modern != tc.modern || cand.Dict != tc.dict {
+				t.Fatalf("expected %s:%s:%s; got %s:%s:%s",
+					tc.sug, tc.modern, tc.dict, cand.Suggestion, cand.Modern, cand.Dict)
+			}
+			if len(cand.HistPatterns) != tc.nhist || len(cand.OCRPatterns) != tc.nocr {
+				t.Fatalf("expected %d/%d patterns; got %d/%d",
+					tc.nhist, tc.nocr, len(cand.HistPatterns), len(cand.OCRPatterns))
+			}
+		})
+	}
+}
+
+func TestMakeCandidateMalformed(t *testing.T) {
+	for _, tc := range []string{
+		"",
+		"theyl",
+		"theil:{teil+[]}+ocr[],voteWeight=0.5,levDistance=1,dict=modern",
+		"theyl@theil:{teil}+ocr[],voteWeight=0.5,levDistance=1,dict=modern",
+		"theyl@theil:{teil+[]}+ocr[],levDistance=1,dict=modern",
+		"theyl@theil:{teil+[]}+ocr[],voteWeight=x,levDistance=1,dict=modern",
+		"theyl@theil:{teil+[]}+ocr[],voteWeight=0.5,levDistance=,dict=modern",
+	} {
+		t.Run(tc, func(t *testing.T) {
+			if _, _, err := MakeCandidate(tc); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestMakeCandidateParseError(t *testing.T) {
+	for _, tc := range []struct {
+		test, field string
+		cause       bool
+	}{
+		{"theyl@theil:{teil+[]}+ocr[],voteWeight=0.5,levDistance=,dict=modern", "levDistance", true},
+		{"theyl@theil:{teil+[]}+ocr[],voteWeight=x,levDistance=1,dict=modern", "voteWeight", true},
+		{"theyl@theil:{teil+[(t:th,x)]}+ocr[],voteWeight=0.5,levDistance=1,dict=modern", "hist patterns", true},
+		{"theyl@theil:{teil+[]}+ocr[(i:y)],voteWeight=0.5,levDistance=1,dict=modern", "ocr patterns", true},
+		{"theyl", "", false},
+	} {
+		t.Run(tc.test, func(t *testing.T) {
+			_, _, err := MakeCandidate(tc.test)
+			perr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("expected *ParseError; got %T: %v", err, err)
+			}
+			if perr.Expr != tc.test {
+				t.Fatalf("expected %s; got %s", tc.test, perr.Expr)
+			}
+			if perr.Field != tc.field {
+				t.Fatalf("expected %q; got %q", tc.field, perr.Field)
+			}
+			if (perr.Err != nil) != tc.cause {
+				t.Fatalf("expected cause=%t; got %v", tc.cause, perr.Err)
+			}
+		})
+	}
+}
+
+func TestMakeCandidateFrequency(t *testing.T) {
+	for _, tc := range []struct {
+		test string
+		dict string
+		want int
+	}{
+		{"a@b:{b+[]}+ocr[(b:a,0)],voteWeight=0.5,levDistance=1,dict=modern", "modern", 0},
+		{"a@b:{b+[]}+ocr[(b:a,0)],voteWeight=0.5,levDistance=1,dict=modern,freq=17", "modern", 17},
+	} {
+		t.Run(tc.test, func(t *testing.T) {
+			cand, _, err := MakeCandidate(tc.test)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if cand.Dict != tc.dict {
+				t.Fatalf("expected dict=%s; got %s", tc.dict, cand.Dict)
+			}
+			if cand.Frequency != tc.want {
+				t.Fatalf("expected freq=%d; got %d", tc.want, cand.Frequency)
+			}
+		})
+	}
+}
+
+func TestReadFrequencyFromJSON(t *testing.T) {
+	const js = `{"Suggestion":"a","Frequency":17}`
+	var cand Candidate
+	if err := json.NewDecoder(strings.NewReader(js)).Decode(&cand); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if cand.Frequency != 17 {
+		t.Fatalf("expected freq=%d; got %d", 17, cand.Frequency)
+	}
+}
+
+func TestBestCandidateFrequency(t *testing.T) {
+	best, ok := bestCandidate([]Candidate{
+		{Suggestion: "a", Weight: 0.5, Frequency: 1},
+		{Suggestion: "b", Weight: 0.5, Frequency: 10},
+		{Suggestion: "c", Weight: 0.1, Frequency: 100},
+	})
+	if !ok {
+		t.Fatalf("expected a best candidate")
+	}
+	if best.Suggestion != "b" {
+		t.Fatalf("expected %s; got %s", "b", best.Suggestion)
+	}
+}
+
+func TestInterpretationBest(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		best, ok := profile["Vnheilfolles"].Best()
+		if !ok {
+			t.Fatalf("expected a best candidate")
+		}
+		if best.Suggestion != "Unheilvolles" || best.Weight != 0.777747 {
+			t.Fatalf("expected %s; got %s", "Unheilvolles", best)
+		}
+		if _, ok := profile["empty"].Best(); ok {
+			t.Fatalf("expected no best candidate")
+		}
+	})
+	i := Interpretation{Candidates: []Candidate{
+		{Suggestion: "c", Weight: 0.5, Distance: 2},
+		{Suggestion: "b", Weight: 0.5, Distance: 1},
+		{Suggestion: "a", Weight: 0.5, Distance: 1},
+		{Suggestion: "d", Weight: 0.1},
+	}}
+	for n := 0; n < 2; n++ {
+		best, _ := i.Best()
+		if best.Suggestion != "a" {
+			t.Fatalf("expected %s; got %s", "a", best.Suggestion)
+		}
+		// The order of the candidates does not matter.
+		i.Candidates[0], i.Candidates[2] = i.Candidates[2], i.Candidates[0]
+	}
+}
+
+func TestInterpretationBestTieBreaks(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cs   []Candidate
+		want string
+	}{
+		{"distance before frequency", []Candidate{
+			{Suggestion: "a", Weight: 0.5, Distance: 2, Frequency: 100},
+			{Suggestion: "b", Weight: 0.5, Distance: 1, Frequency: 1},
+		}, "b"},
+		{"frequency before suggestion", []Candidate{
+			{Suggestion: "a", Weight: 0.5, Distance: 1, Frequency: 1},
+			{Suggestion: "b", Weight: 0.5, Distance: 1, Frequency: 10},
+		}, "b"},
+		{"weight before distance", []Candidate{
+			{Suggestion: "a", Weight: 0.5, Distance: 1},
+			{Suggestion: "b", Weight: 0.6, Distance: 3},
+		}, "b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			best, ok := Interpretation{Candidates: tc.cs}.Best()
+			if !ok || best.Suggestion != tc.want {
+				t.Fatalf("expected %s; got %s", tc.want, best.Suggestion)
+			}
+		})
+	}
+}
+
+func TestInterpretationSortCandidates(t *testing.T) {
+	withOpenProfile(func(in io.Reader) {
+		profile := make(Profile)
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		i := profile["Vnheilfolles"]
+		i.SortCandidates()
+		if got := len(i.Candidates); got != 41 {
+			t.Fatalf("expected %d candidates; got %d", 41, got)
+		}
+		for j := 1; j < len(i.Candidates); j++ {
+			if i.Candidates[j-1].Weight < i.Candidates[j].Weight {
+				t.Fatalf("expected %f >= %f", i.Candidates[j-1].Weight, i.Candidates[j].Weight)
+			}
+		}
+	})
+	i := Interpretation{Candidates: []Candidate{
+		{Suggestion: "a", Weight: 0.5, Distance: 2},
+		{Suggestion: "b", Weight: 0.5, Distance: 1},
+		{Suggestion: "c", Weight: 0.7, Distance: 3},
+		{Suggestion: "d", Weight: 0.5, Distance: 2},
+	}}
+	i.SortCandidates()
+	var got string
+	for _, c := range i.Candidates {
+		got += c.Suggestion
+	}
+	if want := "cbad"; got != want {
+		t.Fatalf("expected %s; got %s", want, got)
+	}
+}
+
+func TestMakeCandidateDecimalComma(t *testing.T) {
+	for _, tc := range []struct{ test, want string }{
+		{
+			"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)];voteWeight=0,74;levDistance=1;dict=modern",
+			"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=0.74,levDistance=1,dict=modern",
+		},
+		{
+			"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)];voteWeight=7,4e-05;levDistance=1;dict=modern;freq=3",
+			"theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=7.4e-05,levDistance=1,dict=modern,freq=3",
+		},
+	} {
+		t.Run(tc.test, func(t *testing.T) {
+			cand, ocr, err := MakeCandidate(tc.test)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got := ocr + "@" + cand.String(); got != tc.want {
+				t.Errorf("expected %s; got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkMakeCandidate(b *testing.B) {
+	const expr = "theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=0.749764,levDistance=1,dict=dict_modern_hypothetic_error"
+	for i := 0; i < b.N; i++ {
+		if _, _, err := MakeCandidate(expr); err != nil {
+			b.Fatalf("got error: %v", err)
+		}
+	}
+}
@@ -1,17 +1,25 @@
 package gofiler
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 // ErrorLanguageNotFound is the error that is returned if a language
@@ -26,6 +34,72 @@ func FindLanguage(backend, language string) (LanguageConfiguration, error) {
 	if err != nil {
 		return LanguageConfiguration{}, err
 	}
+	return findLanguage(lcs, language)
+}
+
+// FindLanguageContext is like FindLanguage but aborts with the error
+// of the context if the context is done before the backend directory
+// could be read.
+func FindLanguageContext(ctx context.Context, backend, language string) (LanguageConfiguration, error) {
+	lcs, err := ListLanguagesContext(ctx, backend)
+	if err != nil {
+		return LanguageConfiguration{}, err
+	}
+	return findLanguage(lcs, language)
+}
+
+// LanguageCache caches the language configurations of backend
+// directories.  The cached configurations of a backend directory are
+// invalidated if the modification time of the directory changes.  The
+// zero value is an empty cache.  A LanguageCache is safe for
+// concurrent use by multiple goroutines.
+type LanguageCache struct {
+	mu      sync.RWMutex
+	entries map[string]languageCacheEntry
+}
+
+type languageCacheEntry struct {
+	mtime time.Time
+	lcs   []LanguageConfiguration
+}
+
+// List returns the language configurations in the given backend
+// directory (see ListLanguages).
+func (c *LanguageCache) List(backend string) ([]LanguageConfiguration, error) {
+	fi, err := os.Stat(backend)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list languages: %v", err)
+	}
+	c.mu.RLock()
+	e, ok := c.entries[backend]
+	c.mu.RUnlock()
+	if ok && e.mtime.Equal(fi.ModTime()) {
+		return append([]LanguageConfiguration(nil), e.lcs...), nil
+	}
+	lcs, err := ListLanguages(backend)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]languageCacheEntry)
+	}
+	c.entries[backend] = languageCacheEntry{mtime: fi.ModTime(), lcs: lcs}
+	return append([]LanguageConfiguration(nil), lcs...), nil
+}
+
+// Find searches the given backend directory for a language
+// configuration (see FindLanguage).
+func (c *LanguageCache) Find(backend, language string) (LanguageConfiguration, error) {
+	lcs, err := c.List(backend)
+	if err != nil {
+		return LanguageConfiguration{}, err
+	}
+	return findLanguage(lcs, language)
+}
+
+func findLanguage(lcs []LanguageConfiguration, language string) (LanguageConfiguration, error) {
 	search := strings.ToLower(language)
 	for _, lc := range lcs {
 		if strings.ToLower(lc.Language) == search {
@@ -65,20 +139,131 @@ func ListLanguages(backend string) ([]LanguageConfiguration, error) {
 	return lcs, nil
 }
 
+// ListLanguagesRecursive returns a list of language configurations in
+// the given backend directory and all its subdirectories.  The
+// language is derived from the base name of the configuration file.
+// The backend directory itself may be a symbolic link, but symbolic
+// links to directories below it are not followed, so symbolic link
+// loops cannot occur.  The paths of the configurations are relative to
+// the given backend directory.
+func ListLanguagesRecursive(backend string) ([]LanguageConfiguration, error) {
+	suf := ".ini"
+	root, err := filepath.EvalSymlinks(backend)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list languages: %v", err)
+	}
+	var lcs []LanguageConfiguration
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		name := fi.Name()
+		if strings.HasSuffix(name, suf) {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			lcs = append(lcs, LanguageConfiguration{
+				Language: strings.ToLower(name[0 : len(name)-len(suf)]),
+				Path:     filepath.Join(backend, rel),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list languages: %v", err)
+	}
+	return lcs, nil
+}
+
+// ListLanguagesContext is like ListLanguages but aborts with the
+// error of the context if the context is done before the backend
+// directory could be read.  The directory is read in a goroutine that
+// is left behind if the read hangs.
+func ListLanguagesContext(ctx context.Context, backend string) ([]LanguageConfiguration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		lcs []LanguageConfiguration
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		lcs, err := ListLanguages(backend)
+		res <- result{lcs, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-res:
+		return r.lcs, r.err
+	}
+}
+
+// ListLanguagesTarGz returns a list of language configurations in
+// the given tar.gz archive without extracting it.  The paths of the
+// configurations are virtual paths of the form `archive/entry`.
+func ListLanguagesTarGz(path string) ([]LanguageConfiguration, error) {
+	suf := ".ini"
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list languages: %v", err)
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list languages: %v", err)
+	}
+	defer gz.Close()
+	var lcs []LanguageConfiguration
+	r := tar.NewReader(gz)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot list languages: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Base(hdr.Name)
+		if strings.HasSuffix(name, suf) {
+			lcs = append(lcs, LanguageConfiguration{
+				Language: strings.ToLower(name[0 : len(name)-len(suf)]),
+				Path:     filepath.Join(path, hdr.Name),
+			})
+		}
+	}
+	return lcs, nil
+}
+
 // Token represents an input token for the profiling.  A token either
 // contains an entry for the extended lexicon (LE) or a text token
 // (OCR) with an optional manual correction (COR).
 //
 // Tokens must never contain any whitespace in any of the strings.
+//
+// The optional ID is never passed to the profiler.  It is used by
+// RunByID to key the resulting profile.  The optional Page and Line
+// are never passed to the profiler either.  They are kept by
+// RunWithProvenance.
 type Token struct {
 	LE, OCR, COR string
+	ID           string
+	Page, Line   int
 }
 
 // String implements the io.Stringer interface.  The output is
 // suitable as direct input for the profiler, i.e each lexicon entry
-// start with `#` all other tokens contain exactly on `:` to seperate
-// the ocr token from the correction token. Tokens with no correction
-// still must end with `:` (they contain an empty correction string).
+// start with `#` all other tokens contain exactly one space to
+// seperate the ocr token from the correction token.  Tokens with no
+// correction consist of the ocr token only.
 func (t Token) String() string {
 	if t.LE != "" {
 		return fmt.Sprintf("#%s", t.LE)
@@ -89,134 +274,1231 @@ func (t Token) String() string {
 	return fmt.Sprintf("%s %s", t.OCR, t.COR)
 }
 
+// Validate returns an error if any of the strings of the token
+// contains whitespace.
+func (t Token) Validate() error {
+	for _, f := range []struct{ name, str string }{{"LE", t.LE}, {"OCR", t.OCR}, {"COR", t.COR}} {
+		if strings.IndexFunc(f.str, unicode.IsSpace) != -1 {
+			return fmt.Errorf("invalid token: whitespace in %s %q", f.name, f.str)
+		}
+	}
+	return nil
+}
+
+// ParseToken parses a token from its profiler input representation
+// (see Token.String).  Lines starting with `#` are lexicon entries.
+// All other lines consist of the ocr token and an optional correction
+// separated by a single space.  Any other whitespace is an error.
+func ParseToken(line string) (Token, error) {
+	if strings.HasPrefix(line, "#") {
+		t := Token{LE: line[1:]}
+		if t.LE == "" || strings.IndexFunc(t.LE, unicode.IsSpace) != -1 {
+			return Token{}, fmt.Errorf("parse token: bad lexicon entry %q", line)
+		}
+		return t, nil
+	}
+	var t Token
+	t.OCR = line
+	if i := strings.IndexByte(line, ' '); i != -1 {
+		t.OCR, t.COR = line[:i], line[i+1:]
+		if t.COR == "" {
+			return Token{}, fmt.Errorf("parse token: empty correction in %q", line)
+		}
+	}
+	if t.OCR == "" {
+		return Token{}, fmt.Errorf("parse token: empty token %q", line)
+	}
+	if err := t.Validate(); err != nil {
+		return Token{}, fmt.Errorf("parse token: %v", err)
+	}
+	return t, nil
+}
+
+// ReadTokensNDJSON reads newline delimited JSON encoded tokens, e.g.
+// `{"ocr":"Waſſer","cor":"Wasser"}`, from the given reader.  It
+// returns an error if any of the tokens contains whitespace.
+func ReadTokensNDJSON(r io.Reader) ([]Token, error) {
+	var tokens []Token
+	d := json.NewDecoder(r)
+	for {
+		var t Token
+		err := d.Decode(&t)
+		if err == io.EOF {
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read tokens: %v", err)
+		}
+		if err := t.Validate(); err != nil {
+			return nil, fmt.Errorf("read tokens: token %d: %v", len(tokens), err)
+		}
+		tokens = append(tokens, t)
+	}
+}
+
 // Logger defines a simple interface for the stderr logger of the
 // profiling.
 type Logger interface {
 	Log(string)
 }
 
+// Level is the severity of a log line of the profiler.
+type Level int
+
+// The severities of the log lines.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levels = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levels) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levels[l]
+}
+
+// LeveledLogger is a logger that distinguishes the severities of the
+// log lines.  If the logger of a profiler implements LeveledLogger,
+// stderr lines with a severity prefix like `[warning]` are logged with
+// Logf and the prefix removed.  All other lines are logged with Log.
+type LeveledLogger interface {
+	Logger
+	Logf(Level, string)
+}
+
+// parseLevel splits the severity prefix from the given log line.  It
+// returns false if the line has no severity prefix.
+func parseLevel(line string) (Level, string, bool) {
+	for i, level := range levels {
+		prefix := "[" + level + "]"
+		if strings.HasPrefix(line, prefix) {
+			return Level(i), strings.TrimSpace(line[len(prefix):]), true
+		}
+	}
+	return 0, line, false
+}
+
 // Profiler is a profiler executable with an optional logger and some
 // minor options.
+//
+// A Profiler is safe for concurrent use by multiple goroutines as long
+// as its fields are not modified.  Each run starts its own profiler
+// process.  The Logger is shared between all runs and must therefore
+// be safe for concurrent use, too.  Runs write their timings into
+// Timing, so a Profiler with Timing must not be used concurrently.
+// RunMulti and RunBatch do not write any timings and can be used with
+// Timing set.
+//
+// Cancelling the context of a run kills the profiler process and
+// removes all temporary files of the run.  To clean up on SIGTERM,
+// cancel the context from a signal handler:
+//
+//	ctx, cancel := context.WithCancel(context.Background())
+//	sigs := make(chan os.Signal, 1)
+//	signal.Notify(sigs, syscall.SIGTERM)
+//	go func() { <-sigs; cancel() }()
 type Profiler struct {
-	args            []string
 	Exe, Config     string
 	Log             Logger
 	Types, Adaptive bool
+	// Lexicon is the path to an additional lexicon file that is
+	// loaded alongside the configuration.  The entries of LE tokens
+	// are added to the lexicon in addition to this file.
+	Lexicon string
+	// If MaxCandidates is greater than zero, the profiler emits at
+	// most MaxCandidates candidates for each token.
+	MaxCandidates int
+	// If NoModern is set, the profiler does not generate modern
+	// forms and the Modern fields of the candidates are empty.
+	NoModern bool
+	// If GzipOutput is set, the profiler compresses its output,
+	// which is transparently decompressed again.
+	GzipOutput bool
+	// ReadBufferSize is the size of the buffer that is used to read
+	// the output of the profiler.  If zero, DefaultReadBufferSize is
+	// used.
+	ReadBufferSize int
+	// Preprocess is an optional function that is applied to each
+	// token before it is passed to the profiler.  The keys of the
+	// resulting profiles are the preprocessed OCR strings.
+	Preprocess func(Token) Token
+	// If Timing is not nil, each successful run stores its timings
+	// in it.
+	Timing *RunTiming
+	// If MinPatternProb is greater than zero, the Run methods that
+	// read the JSON output drop all patterns with a lower
+	// probability.  The profile is decoded one interpretation at a
+	// time and the patterns of an interpretation are filtered right
+	// after it is decoded, so at most the dropped patterns of one
+	// interpretation are held in memory at once.
+	MinPatternProb float64
+	// Sentinel is an optional OCR token that Run appends to the
+	// input tokens to detect truncated output.  The sentinel is not
+	// preprocessed.  It is only used by Run and the methods that are
+	// built on it, like RunBatch and RunMulti; the other Run methods
+	// ignore it.
+	Sentinel string
+	// If PartialOnTimeout is set, RunFunc does not fail if the
+	// deadline of its context is exceeded.  The profiler process is
+	// killed and the candidates that were already delivered to the
+	// callback are kept.
+	PartialOnTimeout bool
+	// FlagStyle defines how the command line flags are passed to
+	// the profiler executable.  It defaults to LongFlags.
+	FlagStyle FlagStyle
+	// SourceFormat is the format of the sources that are profiled
+	// with RunSource, e.g. `TXT`.  If empty, `EXT` is used.  Tokens
+	// are always passed in the `EXT` format.
+	SourceFormat string
+	// Args are additional arguments that are passed verbatim to the
+	// profiler after all managed arguments.  They must not contain
+	// any of the managed flags like `--config`, `--sourceFile` or
+	// the output flags.
+	Args []string
+	// Progress is an optional function that RunFunc calls whenever
+	// the callback receives the candidates of a new OCR token.  Done
+	// is the number of distinct OCR tokens seen so far and total the
+	// number of distinct OCR tokens that were submitted.  Since the
+	// profiler does not report any counts, done is only an estimate.
+	Progress func(done, total int)
+	// Concurrency is the maximal number of profiler processes that
+	// RunBatch runs at once.  If zero, the documents are profiled
+	// sequentially.
+	Concurrency int
+}
+
+// FlagStyle defines the style of the command line flags of the
+// profiler executable.
+type FlagStyle int
+
+// The flag styles.  LongFlags uses double-dash long flags like
+// `--config`.  ShortFlags uses single-dash short flags like `-c`.
+const (
+	LongFlags FlagStyle = iota
+	ShortFlags
+)
+
+// shortFlags maps the long flags of the profiler to their short
+// counterparts.
+var shortFlags = map[string]string{
+	"--config":            "-c",
+	"--sourceFormat":      "-f",
+	"--sourceFile":        "-s",
+	"--jsonOutput":        "-j",
+	"--simpleOutput":      "-o",
+	"--correctionList":    "-l",
+	"--statsOutput":       "-S",
+	"--types":             "-t",
+	"--adaptive":          "-a",
+	"--additionalLexicon": "-x",
+	"--noModern":          "-m",
+	"--gzipOutput":        "-z",
+	"--nrOfCandidates":    "-n",
+}
+
+// flags converts the given long flag arguments to the flag style.
+// Arguments that are not flags are left unchanged.
+func (s FlagStyle) flags(args []string) []string {
+	if s != ShortFlags {
+		return args
+	}
+	ret := make([]string, len(args))
+	for i, arg := range args {
+		ret[i] = arg
+		if short, ok := shortFlags[arg]; ok {
+			ret[i] = short
+		}
+	}
+	return ret
 }
 
+// ErrTruncatedOutput is the error that is returned if the sentinel
+// token is missing in the profiler's output.
+var ErrTruncatedOutput = errors.New("truncated profiler output")
+
 // Run profiles a list of tokens and returns the resulting profile.
+// If a Sentinel is set, it is profiled as the last token and removed
+// from the resulting profile.  Run returns ErrTruncatedOutput if the
+// sentinel is missing in the profile.
 func (p *Profiler) Run(ctx context.Context, tokens []Token) (Profile, error) {
-	p.args = []string{
+	write := p.tokenWriter(tokens)
+	if p.Sentinel != "" {
+		// The sentinel is not preprocessed, so it can be looked up
+		// in the profile.
+		write = func(ctx context.Context, w io.Writer) error {
+			if err := writeTokens(ctx, w, tokens, p.Preprocess); err != nil {
+				return err
+			}
+			return writeTokens(ctx, w, []Token{{OCR: p.Sentinel}}, nil)
+		}
+	}
+	args := []string{
 		"--config",
 		p.Config,
 		"--sourceFormat",
 		"EXT",
-		"--sourceFile",
-		"/dev/stdin",
-		"--jsonOutput",
-		"/dev/stdout",
 	}
 	var profile Profile
-	err := p.run(ctx, tokens, func(r io.Reader) error {
-		if err := json.NewDecoder(r).Decode(&profile); err != nil {
-			return fmt.Errorf("cannot decode profile: %v", err)
+	err := p.runJSONSource(ctx, args, write, func(r io.Reader) error {
+		var err error
+		profile, err = p.readProfile(r)
+		return err
+	})
+	if err != nil || p.Sentinel == "" {
+		return profile, err
+	}
+	if _, ok := profile[p.Sentinel]; !ok {
+		return nil, ErrTruncatedOutput
+	}
+	delete(profile, p.Sentinel)
+	return profile, nil
+}
+
+// RunObserve profiles a list of tokens and returns the resulting
+// profile like Run.  Additionally f is called for each interpretation
+// as soon as it is decoded.  The callback gets a copy of the
+// interpretation, so it cannot modify the resulting profile.
+func (p *Profiler) RunObserve(ctx context.Context, tokens []Token, f func(Interpretation)) (Profile, error) {
+	args := []string{
+		"--config",
+		p.Config,
+		"--sourceFormat",
+		"EXT",
+	}
+	profile := make(Profile)
+	err := p.runJSON(ctx, args, tokens, func(r io.Reader) error {
+		return p.decodeProfile(r, func(ocr string, i Interpretation) error {
+			profile[ocr] = i
+			f(i.clone())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// RunStream profiles a list of tokens and calls f for each
+// interpretation of the resulting profile.  The profile is decoded
+// incrementally and never held in memory as a whole.  If f returns an
+// error, the run is aborted.  If f returns ErrStopIteration, RunStream
+// returns nil.
+func (p *Profiler) RunStream(ctx context.Context, tokens []Token, f func(string, Interpretation) error) error {
+	args := []string{
+		"--config",
+		p.Config,
+		"--sourceFormat",
+		"EXT",
+	}
+	return p.runJSON(ctx, args, tokens, func(r io.Reader) error {
+		return p.decodeProfile(r, f)
+	})
+}
+
+// RunSource profiles the given source and returns the resulting
+// profile.  The source is passed verbatim to the profiler, so it must
+// be in the profiler's SourceFormat.  The Preprocess function and the
+// Sentinel are not used.  The source is read before the profiler is
+// started; the context is checked between reads, so a blocking read
+// of the source is not interrupted.
+func (p *Profiler) RunSource(ctx context.Context, src io.Reader) (Profile, error) {
+	args := []string{
+		"--config",
+		p.Config,
+		"--sourceFormat",
+		p.sourceFormat(),
+	}
+	write := func(ctx context.Context, w io.Writer) error {
+		if _, err := io.Copy(w, ctxReader{ctx: ctx, r: src}); err != nil {
+			return fmt.Errorf("write source: %v", err)
 		}
 		return nil
+	}
+	var profile Profile
+	err := p.runJSONSource(ctx, args, write, func(r io.Reader) error {
+		var err error
+		profile, err = p.readProfile(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// sourceFormat returns the source format of the profiler.
+func (p *Profiler) sourceFormat() string {
+	if p.SourceFormat == "" {
+		return "EXT"
+	}
+	return p.SourceFormat
+}
+
+// decodeProfile decodes a profile from the given reader one
+// interpretation at a time (see decodeProfile).  If MinPatternProb is
+// set, the patterns of each interpretation are filtered before f is
+// called.
+func (p *Profiler) decodeProfile(r io.Reader, f func(string, Interpretation) error) error {
+	return decodeProfile(r, func(ocr string, i Interpretation) error {
+		if p.MinPatternProb > 0 {
+			i.dropPatterns(p.MinPatternProb)
+		}
+		return f(ocr, i)
 	})
-	return profile, err
 }
 
+// readProfile decodes the profile from the given reader.  If
+// MinPatternProb is set, the patterns of each interpretation are
+// filtered while decoding.
+func (p *Profiler) readProfile(r io.Reader) (Profile, error) {
+	if p.MinPatternProb > 0 {
+		profile := make(Profile)
+		err := p.decodeProfile(r, func(ocr string, i Interpretation) error {
+			profile[ocr] = i
+			return nil
+		})
+		return profile, err
+	}
+	var profile Profile
+	if err := json.NewDecoder(r).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("cannot decode profile: %v", err)
+	}
+	return profile, nil
+}
+
+// Check runs the profiler executable with `--version` to check that it
+// exists and can be run.  A non-zero exit status of the executable is
+// not considered an error.  Check returns an error if the executable
+// cannot be started or if the context is done before it finishes.
+func (p *Profiler) Check(ctx context.Context) error {
+	err := exec.CommandContext(ctx, p.Exe, "--version").Run()
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("check profiler: %v", err)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return fmt.Errorf("check profiler: %v", err)
+	}
+	return nil
+}
+
+// Version runs the profiler executable with `--version` and returns
+// its trimmed output.  If the executable writes nothing to stdout, its
+// output to stderr is used.
+func (p *Profiler) Version(ctx context.Context) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Exe, "--version")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("profiler version: %v", err)
+	}
+	if version := strings.TrimSpace(stdout.String()); version != "" {
+		return version, nil
+	}
+	return strings.TrimSpace(stderr.String()), nil
+}
+
+// BatchTokens splits the given tokens into batches of at most size
+// tokens.  If size is not positive, all tokens are put into a single
+// batch.
+func BatchTokens(tokens []Token, size int) [][]Token {
+	if size <= 0 || len(tokens) <= size {
+		return [][]Token{tokens}
+	}
+	var batches [][]Token
+	for len(tokens) > size {
+		batches = append(batches, tokens[:size:size])
+		tokens = tokens[size:]
+	}
+	if len(tokens) > 0 {
+		batches = append(batches, tokens)
+	}
+	return batches
+}
+
+// RunBatched profiles the tokens in batches of the given size and
+// merges the resulting profiles.  Each batch is profiled with its own
+// profiler process, which bounds the memory usage of the profiler.
+// The profiler only sees the tokens of one batch at a time, so any
+// adaptive learning across batches is lost.
+func (p *Profiler) RunBatched(ctx context.Context, tokens []Token, size int) (Profile, error) {
+	profile := make(Profile)
+	for _, batch := range BatchTokens(tokens, size) {
+		bprofile, err := p.Run(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for ocr, i := range bprofile {
+			profile.add(ocr, i)
+		}
+	}
+	return profile, nil
+}
+
+// RunByID profiles a list of tokens and returns the resulting profile
+// keyed by the IDs of the tokens instead of their OCR strings.  Each
+// token with an ID maps to the interpretation of its OCR string, so
+// repeated OCR strings with distinct IDs do not collide.  The OCR
+// string is kept in the interpretation's OCR field.  Lexicon entries,
+// tokens without an ID and tokens that are missing in the profile are
+// skipped.
+func (p *Profiler) RunByID(ctx context.Context, tokens []Token) (Profile, error) {
+	profile, err := p.Run(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(Profile)
+	for _, t := range p.preprocess(tokens) {
+		if t.LE != "" || t.ID == "" {
+			continue
+		}
+		i, ok := profile[t.OCR]
+		if !ok {
+			continue
+		}
+		i.OCR = t.OCR
+		ret[t.ID] = i
+	}
+	return ret, nil
+}
+
+// RunWithProvenance profiles a list of tokens and associates the
+// interpretations of the resulting profile with the pages and lines
+// of their input tokens (see Profile.WithProvenance).
+func (p *Profiler) RunWithProvenance(ctx context.Context, tokens []Token) (ProfileWithProvenance, error) {
+	profile, err := p.Run(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+	return profile.WithProvenance(p.preprocess(tokens)), nil
+}
+
+// RunTokensNDJSON reads newline delimited JSON encoded tokens from the
+// given reader (see ReadTokensNDJSON) and profiles them.
+func (p *Profiler) RunTokensNDJSON(ctx context.Context, r io.Reader) (Profile, error) {
+	tokens, err := ReadTokensNDJSON(r)
+	if err != nil {
+		return nil, err
+	}
+	return p.Run(ctx, tokens)
+}
+
+// RunStats holds the statistics of a profiler run.
+type RunStats struct {
+	Tokens        int     // Number of processed tokens
+	KnownTokens   int     // Number of tokens found in the lexicon
+	UnknownTokens int     // Number of tokens not found in the lexicon
+	Duration      float64 // Processing time in seconds
+}
+
+// RunWithStats profiles a list of tokens and returns the resulting
+// profile together with the statistics of the profiler run.
+func (p *Profiler) RunWithStats(ctx context.Context, tokens []Token) (Profile, RunStats, error) {
+	stats, err := ioutil.TempFile("", "gofiler-stats-*.json")
+	if err != nil {
+		return nil, RunStats{}, fmt.Errorf("run profiler: %v", err)
+	}
+	stats.Close()
+	defer os.Remove(stats.Name())
+	args := []string{
+		"--config",
+		p.Config,
+		"--sourceFormat",
+		"EXT",
+		"--statsOutput",
+		stats.Name(),
+	}
+	var profile Profile
+	err = p.runJSON(ctx, args, tokens, func(r io.Reader) error {
+		var err error
+		profile, err = p.readProfile(r)
+		return err
+	})
+	if err != nil {
+		return nil, RunStats{}, err
+	}
+	var rs RunStats
+	in, err := os.Open(stats.Name())
+	if err != nil {
+		return nil, RunStats{}, fmt.Errorf("run profiler: %v", err)
+	}
+	defer in.Close()
+	if err := json.NewDecoder(in).Decode(&rs); err != nil {
+		return nil, RunStats{}, fmt.Errorf("cannot decode stats: %v", err)
+	}
+	return profile, rs, nil
+}
+
+// RunMultiOptions are the options for RunMulti.
+type RunMultiOptions struct {
+	// If ContinueOnError is set, a failing run does not cancel the
+	// other runs.  The errors are reported in the results instead.
+	ContinueOnError bool
+}
+
+// RunMultiResult is the result of a run with one configuration.
+type RunMultiResult struct {
+	Profile Profile
+	Err     error
+}
+
+// RunMulti profiles a list of tokens with multiple configurations
+// concurrently and returns the results keyed by the configurations.
+// The Config of the profiler is ignored.  By default the first
+// failing run cancels all other runs and its error is returned.  The
+// runs do not store their timings in Timing.
+func (p *Profiler) RunMulti(ctx context.Context, configs []string, tokens []Token, opts RunMultiOptions) (map[string]RunMultiResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	results := make(map[string]RunMultiResult, len(configs))
+	for _, config := range configs {
+		wg.Add(1)
+		go func(config string) {
+			defer wg.Done()
+			q := *p
+			q.Config = config
+			q.Timing = nil
+			profile, err := q.Run(ctx, tokens)
+			mu.Lock()
+			defer mu.Unlock()
+			results[config] = RunMultiResult{Profile: profile, Err: err}
+			if err != nil && !opts.ContinueOnError && first == nil {
+				first = fmt.Errorf("run multi %s: %w", config, err)
+				cancel()
+			}
+		}(config)
+	}
+	wg.Wait()
+	if first != nil {
+		return nil, first
+	}
+	return results, nil
+}
+
+// BatchError is the error that is returned by RunBatch if any of the
+// documents could not be profiled.  It maps the keys of the failed
+// documents to their errors.
+type BatchError map[string]error
+
+func (e BatchError) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = fmt.Sprintf("%s: %v", key, e[key])
+	}
+	return fmt.Sprintf("run batch: %s", strings.Join(msgs, "; "))
+}
+
+// RunBatch profiles multiple documents and returns their profiles
+// keyed by the keys of the documents.  Each document is profiled with
+// its own profiler process; at most Concurrency processes run at once.
+// All documents are profiled even if some of them fail.  In this case
+// the profiles of the successful documents are returned together with
+// a BatchError.  If the context is done, no new processes are started
+// and RunBatch waits for the running ones.  The runs do not store
+// their timings in Timing.
+func (p *Profiler) RunBatch(ctx context.Context, docs map[string][]Token) (map[string]Profile, error) {
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	profiles := make(map[string]Profile, len(docs))
+	errs := make(BatchError)
+	q := *p
+	q.Timing = nil
+	n := p.Concurrency
+	if n <= 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				var profile Profile
+				err := ctx.Err()
+				if err == nil {
+					profile, err = q.Run(ctx, docs[key])
+				}
+				mu.Lock()
+				if err != nil {
+					errs[key] = err
+				} else {
+					profiles[key] = profile
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for key := range docs {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+	if len(errs) > 0 {
+		return profiles, errs
+	}
+	return profiles, nil
+}
+
+// RunWithLexicon profiles a list of tokens with additional entries
+// for the extended lexicon.  The lexicon entries are written as LE
+// tokens before the given tokens, so the profiler knows them when it
+// processes the OCR tokens.
+func (p *Profiler) RunWithLexicon(ctx context.Context, lexicon []string, tokens []Token) (Profile, error) {
+	ts := make([]Token, 0, len(lexicon)+len(tokens))
+	for _, entry := range lexicon {
+		ts = append(ts, Token{LE: entry})
+	}
+	return p.Run(ctx, append(ts, tokens...))
+}
+
+// ErrStopIteration can be returned by the callback function of
+// RunFunc to stop the profiling early.  The profiler process is
+// killed and RunFunc returns nil.
+var ErrStopIteration = errors.New("stop iteration")
+
 // RunFunc profiles a list of tokens.  The optional logger is used to
 // write the process's stderr.  The callback function is called for
-// every Profiler candidate with the according ocr token.
+// every Profiler candidate with the according ocr token.  If the
+// callback returns ErrStopIteration, the profiling is stopped and
+// RunFunc returns nil.  If the output of the profiler cannot be
+// parsed, the returned error wraps the according *ParseError.
+//
+// The output of the profiler is only buffered up to ReadBufferSize.
+// A slow callback function blocks the profiler process once the
+// buffers are full.
 func (p *Profiler) RunFunc(ctx context.Context, tokens []Token, f func(string, Candidate) error) error {
-	p.args = []string{
+	args := []string{
 		"--config",
 		p.Config,
 		"--sourceFormat",
 		"EXT",
-		"--sourceFile",
-		"/dev/stdin",
 		"--simpleOutput",
 	}
-	return p.run(ctx, tokens, func(r io.Reader) error {
+	if p.Progress != nil {
+		f = p.progress(tokens, f)
+	}
+	err := p.run(ctx, args, tokens, func(r io.Reader) error {
 		s := bufio.NewScanner(r)
 		for s.Scan() {
 			cand, ocr, err := MakeCandidate(s.Text())
 			if err != nil {
-				return fmt.Errorf("read candidate: %v", err)
+				return fmt.Errorf("read candidate: %w", err)
 			}
 			if err := f(ocr, cand); err != nil {
-				return fmt.Errorf("read candidate: %v", err)
+				if err == ErrStopIteration {
+					return err
+				}
+				return fmt.Errorf("read candidate: %w", err)
 			}
 		}
 		return s.Err()
 	})
+	if err != nil && p.PartialOnTimeout && ctx.Err() == context.DeadlineExceeded {
+		return nil
+	}
+	return err
+}
+
+// RunResume profiles a list of tokens like RunFunc, but only calls f
+// for the candidates of the tokens at index skip or later.  This can
+// be used to resume an interrupted run.  The profiler still processes
+// all tokens, since it needs the skipped tokens as context.
+//
+// The candidates in the output are assigned to the input tokens in
+// order.  Consecutive tokens with the same OCR string cannot be
+// distinguished in the output; their candidates are assigned to the
+// first of them.
+func (p *Profiler) RunResume(ctx context.Context, tokens []Token, skip int, f func(string, Candidate) error) error {
+	pts := p.preprocess(tokens)
+	k := -1
+	return p.RunFunc(ctx, tokens, func(ocr string, cand Candidate) error {
+		if k < 0 || pts[k].OCR != ocr {
+			j := findToken(pts, k+1, ocr)
+			if j < 0 {
+				return fmt.Errorf("resume: unexpected token %s", ocr)
+			}
+			k = j
+		}
+		if k < skip {
+			return nil
+		}
+		return f(ocr, cand)
+	})
+}
+
+// progress wraps f such that p.Progress is called for every new OCR
+// token that is passed to f.  The total is the number of distinct
+// preprocessed OCR tokens; lexicon entries are not counted.
+func (p *Profiler) progress(tokens []Token, f func(string, Candidate) error) func(string, Candidate) error {
+	distinct := make(map[string]bool)
+	for _, t := range p.preprocess(tokens) {
+		if t.LE == "" && t.OCR != "" {
+			distinct[t.OCR] = true
+		}
+	}
+	total := len(distinct)
+	seen := make(map[string]bool)
+	return func(ocr string, cand Candidate) error {
+		if !seen[ocr] {
+			seen[ocr] = true
+			p.Progress(len(seen), total)
+		}
+		return f(ocr, cand)
+	}
+}
+
+// preprocess returns the preprocessed tokens.  It returns the tokens
+// unchanged if no Preprocess function is set.
+func (p *Profiler) preprocess(tokens []Token) []Token {
+	if p.Preprocess == nil {
+		return tokens
+	}
+	ret := make([]Token, len(tokens))
+	for i, t := range tokens {
+		ret[i] = p.Preprocess(t)
+	}
+	return ret
+}
+
+// findToken returns the index of the first non lexicon token with the
+// given OCR string starting at index i.  It returns -1 if no such
+// token exists.
+func findToken(tokens []Token, i int, ocr string) int {
+	for ; i < len(tokens); i++ {
+		if tokens[i].LE == "" && tokens[i].OCR == ocr {
+			return i
+		}
+	}
+	return -1
+}
+
+// RunCorrections profiles a list of tokens and returns the according
+// corrections of the OCR tokens.  The profiler is run with its compact
+// correction list output (`ocr -> correction` for each line).  If the
+// profiler does not support the correction list, i.e. if it fails
+// with an error message that names the correction list flag, the
+// corrections are derived from the best candidates of a full profile.
+// All other errors are returned as is.
+func (p *Profiler) RunCorrections(ctx context.Context, tokens []Token) (map[string]string, error) {
+	args := []string{
+		"--config",
+		p.Config,
+		"--sourceFormat",
+		"EXT",
+		"--correctionList",
+	}
+	var corrections map[string]string
+	var rerr error
+	err := p.run(ctx, args, tokens, func(r io.Reader) error {
+		corrections, rerr = readCorrections(r)
+		return rerr
+	})
+	if err == nil {
+		return corrections, nil
+	}
+	// Only fall back to a full profile if the profiler exits with an
+	// error that complains about the unsupported flag.
+	flag := "--correctionList"
+	if p.FlagStyle == ShortFlags {
+		flag = shortFlags[flag]
+	}
+	var exit *ExitError
+	if rerr != nil || !errors.As(err, &exit) || !strings.Contains(exit.Stderr, flag) {
+		return nil, err
+	}
+	profile, err := p.Run(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+	return profile.Suggestions(), nil
+}
+
+func readCorrections(r io.Reader) (map[string]string, error) {
+	corrections := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if s.Text() == "" {
+			continue
+		}
+		fields := strings.SplitN(s.Text(), " -> ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("read correction: bad expression %s", s.Text())
+		}
+		corrections[fields[0]] = fields[1]
+	}
+	return corrections, s.Err()
+}
+
+// EvalResult is the result of an evaluation.  Accuracy is the fraction
+// of the evaluated tokens whose correction matches the expected one.
+type EvalResult struct {
+	Accuracy   float64
+	Mismatches []EvalMismatch
+}
+
+// EvalMismatch is an evaluated token whose correction Got differs
+// from its expected correction Token.COR.
+type EvalMismatch struct {
+	Token Token
+	Got   string
+}
+
+// Evaluate profiles the OCR tokens of the given pairs and compares
+// their corrections (see Profile.Correct) with the expected
+// corrections in the COR fields.  Only the OCR sides are passed to the
+// profiler; the expected corrections are not.  Lexicon entries are
+// passed to the profiler but are not evaluated.  The accuracy of an
+// evaluation without any OCR tokens is 0.
+func (p *Profiler) Evaluate(ctx context.Context, pairs []Token, minWeight float32) (EvalResult, error) {
+	ocrs := make([]Token, len(pairs))
+	for i, t := range pairs {
+		ocrs[i] = Token{LE: t.LE, OCR: t.OCR}
+	}
+	profile, err := p.Run(ctx, ocrs)
+	if err != nil {
+		return EvalResult{}, err
+	}
+	corrections := profile.Correct(pairs, minWeight)
+	var res EvalResult
+	var n int
+	for i, t := range pairs {
+		if t.LE != "" {
+			continue
+		}
+		n++
+		if corrections[i] != t.COR {
+			res.Mismatches = append(res.Mismatches, EvalMismatch{Token: t, Got: corrections[i]})
+		}
+	}
+	if n > 0 {
+		res.Accuracy = float64(n-len(res.Mismatches)) / float64(n)
+	}
+	return res, nil
 }
 
 // RunWriter profiles a list of tokens and writes the resulting
 // profile (formated as json) into the given writer.
 func (p *Profiler) RunWriter(ctx context.Context, tokens []Token, w io.Writer) error {
-	p.args = []string{
+	args := []string{
 		"--config",
 		p.Config,
 		"--sourceFormat",
 		"EXT",
-		"--sourceFile",
-		"/dev/stdin",
-		"--jsonOutput",
-		"/dev/stdout",
 	}
-	return p.run(ctx, tokens, func(r io.Reader) error {
+	return p.runJSON(ctx, args, tokens, func(r io.Reader) error {
 		_, err := io.Copy(w, r)
 		return err
 	})
 }
 
-func (p *Profiler) run(ctx context.Context, tokens []Token, f func(io.Reader) error) error {
-	if p.Types {
-		p.args = append(p.args, "--types")
+// RunPipe profiles a list of tokens and copies the simple output of
+// the profiler verbatim into the given writer.  The output is not
+// decoded, so it can be passed on to other tools efficiently.  Use
+// RunWriter to get the profile formatted as json.
+func (p *Profiler) RunPipe(ctx context.Context, tokens []Token, dst io.Writer) error {
+	args := []string{
+		"--config",
+		p.Config,
+		"--sourceFormat",
+		"EXT",
+		"--simpleOutput",
 	}
-	if p.Adaptive {
-		p.args = append(p.args, "--adaptive")
+	return p.run(ctx, args, tokens, func(r io.Reader) error {
+		_, err := io.Copy(dst, r)
+		return err
+	})
+}
+
+// run runs the profiler and calls f with the output of the profiler
+// as it is written to stdout.
+func (p *Profiler) run(ctx context.Context, args []string, tokens []Token, f func(io.Reader) error) error {
+	return p.exec(ctx, args, p.tokenWriter(tokens), "", f)
+}
+
+// runJSON runs the profiler with its json output written into a
+// temporary file and calls f with the output after the profiler has
+// finished.
+func (p *Profiler) runJSON(ctx context.Context, args []string, tokens []Token, f func(io.Reader) error) error {
+	return p.runJSONSource(ctx, args, p.tokenWriter(tokens), f)
+}
+
+// runJSONSource is like runJSON but the source file is written by the
+// given write function.
+func (p *Profiler) runJSONSource(ctx context.Context, args []string, write func(context.Context, io.Writer) error, f func(io.Reader) error) error {
+	out, err := ioutil.TempFile("", "gofiler-profile-*.json")
+	if err != nil {
+		return fmt.Errorf("run profiler: %v", err)
 	}
-	// g, gctx := errgroup.WithContext(ctx)
-	// stdin, pw := io.Pipe()
-	// pr, stdout := io.Pipe()
-	cmd := exec.CommandContext(ctx, p.Exe, p.args...)
-	if p.Log != nil {
-		p.Log.Log(fmt.Sprintf("cmd: %s %s", p.Exe, strings.Join(p.args, " ")))
-		cmd.Stderr = &logwriter{logger: p.Log}
+	out.Close()
+	defer os.Remove(out.Name())
+	return p.exec(ctx, args, write, out.Name(), f)
+}
+
+// tokenWriter returns a function that writes the preprocessed tokens.
+func (p *Profiler) tokenWriter(tokens []Token) func(context.Context, io.Writer) error {
+	return func(ctx context.Context, w io.Writer) error {
+		return writeTokens(ctx, w, tokens, p.Preprocess)
 	}
-	stdin, err := cmd.StdinPipe()
+}
+
+// exec runs the profiler.  The source file of the profiler is a
+// temporary file that is written by the given write function before
+// the profiler is started.  If the context is done before the source
+// file is written, exec returns the error of the context.  The write
+// function has returned in any case when exec returns.  If output is empty, f is called with the
+// stdout of the profiler.  Otherwise the profiler writes its json
+// output into the output file and f is called with the output file
+// after the profiler has finished.  All temporary files are removed if
+// exec returns, even if the context is cancelled.
+func (p *Profiler) exec(ctx context.Context, args []string, write func(context.Context, io.Writer) error, output string, f func(io.Reader) error) error {
+	if p.Lexicon != "" {
+		if _, err := os.Stat(p.Lexicon); err != nil {
+			return fmt.Errorf("run profiler: additional lexicon: %v", err)
+		}
+	}
+	var timing RunTiming
+	start := time.Now()
+	source, err := ioutil.TempFile("", "gofiler-source-*.txt")
 	if err != nil {
-		return fmt.Errorf("run profiler: connect stdin: %v", err)
+		return fmt.Errorf("run profiler: %v", err)
+	}
+	defer os.Remove(source.Name())
+	err = write(ctx, source)
+	if cerr := source.Close(); err == nil {
+		err = cerr
 	}
-	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("run profiler: connect stdout: %v", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("run profiler: %v", err)
+	}
+	timing.WriteDuration = time.Since(start)
+	args = append(args[:len(args):len(args)], "--sourceFile", source.Name())
+	if output != "" {
+		args = append(args, "--jsonOutput", output)
+	}
+	if p.Types {
+		args = append(args, "--types")
+	}
+	if p.Adaptive {
+		args = append(args, "--adaptive")
+	}
+	if p.Lexicon != "" {
+		args = append(args, "--additionalLexicon", p.Lexicon)
+	}
+	if p.NoModern {
+		args = append(args, "--noModern")
+	}
+	if p.GzipOutput {
+		args = append(args, "--gzipOutput")
 	}
-	// Run profiler: write input and read output.
+	if p.MaxCandidates > 0 {
+		args = append(args, "--nrOfCandidates", strconv.Itoa(p.MaxCandidates))
+	}
+	args = append(p.FlagStyle.flags(args), p.Args...)
+	cmd := exec.CommandContext(ctx, p.Exe, args...)
+	// Always keep the tail of stderr for the errors.
+	stderr := newTailBuffer(stderrTailSize)
+	cmd.Stderr = stderr
+	if p.Log != nil {
+		p.Log.Log(fmt.Sprintf("cmd: %s %s", p.Exe, strings.Join(args, " ")))
+		cmd.Stderr = io.MultiWriter(&logwriter{logger: p.Log}, stderr)
+	}
+	var stdout io.Reader
+	if output == "" {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return fmt.Errorf("run profiler: connect stdout: %v", err)
+		}
+	}
+	start = time.Now()
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("run profiler: %v", err)
 	}
-	if err := writeTokens(stdin, tokens); err != nil {
-		return fmt.Errorf("run profiler: %v", err)
+	timing.StartDuration = time.Since(start)
+	start = time.Now()
+	if output != "" {
+		// Wait for the profiler to finish its output file.
+		if err := cmd.Wait(); err != nil {
+			return waitError(ctx, err, stderr)
+		}
+		if err := p.readFile(output, f); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return fmt.Errorf("run profiler: %w", err)
+		}
+	} else {
+		// Stdout is read directly from the pipe with a bounded
+		// read buffer, so a slow reader blocks the profiler
+		// process.  No need to close stdout; cmd takes care of
+		// this.
+		if err := p.read(stdout, f); err != nil {
+			// Stop the profiler; errors from the killed
+			// process are of no interest.
+			cmd.Process.Kill()
+			cmd.Wait()
+			if err == ErrStopIteration {
+				return nil
+			}
+			return fmt.Errorf("run profiler: %w", err)
+		}
+		if err := cmd.Wait(); err != nil {
+			return waitError(ctx, err, stderr)
+		}
 	}
-	// No need to close stdout; cmd takes care of this.
-	if err := f(stdout); err != nil {
-		return fmt.Errorf("run profiler: %v", err)
+	timing.ReadDuration = time.Since(start)
+	if p.Timing != nil {
+		*p.Timing = timing
+	}
+	return nil
+}
+
+// ExitError is the error that is returned if the profiler exits with
+// a non-zero exit code.  Stderr holds the tail of the profiler's
+// output to stderr.
+type ExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("run profiler: exit status %d", e.Code)
 	}
-	// Wait for the command to finish.
-	if err := cmd.Wait(); err != nil {
+	return fmt.Sprintf("run profiler: exit status %d: %s", e.Code, e.Stderr)
+}
+
+// waitError returns an *ExitError if the profiler exited with a
+// non-zero exit code.  Processes that were killed because the context
+// is done do not result in an *ExitError.  The tail of stderr is part
+// of the returned error.
+func waitError(ctx context.Context, err error, stderr *tailBuffer) error {
+	tail := strings.TrimSpace(stderr.String())
+	if exit, ok := err.(*exec.ExitError); ok && ctx.Err() == nil && exit.ExitCode() > 0 {
+		return &ExitError{Code: exit.ExitCode(), Stderr: tail}
+	}
+	if tail == "" {
 		return fmt.Errorf("run profiler: %v", err)
 	}
-	return nil
+	return fmt.Errorf("run profiler: %v: %s", err, tail)
+}
+
+// stderrTailSize is the number of bytes of the tail of stderr that
+// are kept for the errors of a run.
+const stderrTailSize = 4 * 1024
+
+// tailBuffer is a ring buffer that keeps the last bytes written to
+// it.
+type tailBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{buf: make([]byte, size)}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if n >= len(b.buf) {
+		copy(b.buf, p[n-len(b.buf):])
+		b.pos, b.full = 0, true
+		return n, nil
+	}
+	c := copy(b.buf[b.pos:], p)
+	if c < n {
+		copy(b.buf, p[c:])
+		b.full = true
+	}
+	b.pos = (b.pos + n) % len(b.buf)
+	if b.pos == 0 && n > 0 {
+		b.full = true
+	}
+	return n, nil
+}
+
+// String returns the bytes in the buffer in the order they were
+// written.
+func (b *tailBuffer) String() string {
+	if !b.full {
+		return string(b.buf[:b.pos])
+	}
+	return string(b.buf[b.pos:]) + string(b.buf[:b.pos])
+}
+
+// RunTiming holds the timings of a profiler run.  The tokens are
+// written before the profiler is started.  The output is read while
+// the profiler is running, so the read duration includes the
+// processing time of the profiler.
+type RunTiming struct {
+	StartDuration time.Duration // Time to start the profiler process
+	WriteDuration time.Duration // Time to write the input tokens
+	ReadDuration  time.Duration // Time to read the output
+}
+
+// readFile calls f with the buffered content of the given output
+// file (see read).
+func (p *Profiler) readFile(path string, f func(io.Reader) error) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return p.read(in, f)
+}
+
+// DefaultReadBufferSize is the default size of the buffer that is
+// used to read the output of the profiler.
+const DefaultReadBufferSize = 64 * 1024
+
+// read calls f with the buffered output of the profiler.  The output
+// is decompressed if GzipOutput is set.
+func (p *Profiler) read(r io.Reader, f func(io.Reader) error) error {
+	size := p.ReadBufferSize
+	if size <= 0 {
+		size = DefaultReadBufferSize
+	}
+	r = bufio.NewReaderSize(r, size)
+	if !p.GzipOutput {
+		return f(r)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("read gzip output: %v", err)
+	}
+	defer gz.Close()
+	return f(gz)
 }
 
-func writeTokens(w io.WriteCloser, ts []Token) error {
-	defer w.Close()
-	for _, t := range ts {
+// writeTokens writes the preprocessed tokens.  It stops with the error
+// of the context if the context is done.
+func writeTokens(ctx context.Context, w io.Writer, ts []Token, preprocess func(Token) Token) error {
+	for i, t := range ts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if preprocess != nil {
+			t = preprocess(t)
+		}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("write token %d: %v", i, err)
+		}
 		if _, err := fmt.Fprintf(w, "%s\n", t); err != nil {
 			return fmt.Errorf("write token %s: %v", t, err)
 		}
@@ -224,6 +1506,20 @@ func writeTokens(w io.WriteCloser, ts []Token) error {
 	return nil
 }
 
+// ctxReader is a reader that fails with the error of its context once
+// the context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 type logwriter struct {
 	logger Logger
 	buffer []byte
@@ -232,8 +1528,18 @@ type logwriter struct {
 func (l *logwriter) Write(p []byte) (int, error) {
 	l.buffer = append(l.buffer, p...)
 	for pos := bytes.IndexByte(l.buffer, '\n'); pos != -1; pos = bytes.IndexByte(l.buffer, '\n') {
-		l.logger.Log(string(l.buffer[:pos]))
+		l.log(string(l.buffer[:pos]))
 		l.buffer = l.buffer[pos+1:]
 	}
 	return len(p), nil
 }
+
+func (l *logwriter) log(line string) {
+	if ll, ok := l.logger.(LeveledLogger); ok {
+		if level, msg, ok := parseLevel(line); ok {
+			ll.Logf(level, msg)
+			return
+		}
+	}
+	l.logger.Log(line)
+}
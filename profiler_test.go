@@ -1,7 +1,19 @@
 package gofiler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -39,6 +51,213 @@ func TestFindLanguage(t *testing.T) {
 	}
 }
 
+func TestListLanguagesRecursive(t *testing.T) {
+	lcs, err := ListLanguagesRecursive("testdata/nested")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := []LanguageConfiguration{
+		{"gothic", "testdata/nested/germanic/Gothic.ini"},
+		{"oscan", "testdata/nested/romance/italic/oscan.ini"},
+	}
+	if fmt.Sprint(lcs) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, lcs)
+	}
+	lcs, err = ListLanguagesRecursive("testdata")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if got := len(lcs); got != 6 {
+		t.Fatalf("expected %d language configurations; got %d", 6, got)
+	}
+	if _, err := ListLanguagesRecursive("testdata/no-such-backend"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestListLanguagesRecursiveSymlinkRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	target, err := filepath.Abs("testdata/nested")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	backend := filepath.Join(dir, "backend")
+	if err := os.Symlink(target, backend); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	lcs, err := ListLanguagesRecursive(backend)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := []LanguageConfiguration{
+		{"gothic", filepath.Join(backend, "germanic/Gothic.ini")},
+		{"oscan", filepath.Join(backend, "romance/italic/oscan.ini")},
+	}
+	if fmt.Sprint(lcs) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, lcs)
+	}
+}
+
+func TestLanguageCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	touch := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	chtime := func(mtime time.Time) {
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	var cache LanguageCache
+	mtime := time.Now().Add(-time.Hour)
+	touch("german.ini")
+	chtime(mtime)
+	// Miss.
+	if lcs, err := cache.List(dir); err != nil || len(lcs) != 1 {
+		t.Fatalf("expected %d language configuration; got %v, %v", 1, lcs, err)
+	}
+	// Hit: the new configuration is not seen, since the
+	// modification time of the directory is unchanged.
+	touch("latin.ini")
+	chtime(mtime)
+	if lcs, err := cache.List(dir); err != nil || len(lcs) != 1 {
+		t.Fatalf("expected %d language configuration; got %v, %v", 1, lcs, err)
+	}
+	if _, err := cache.Find(dir, "latin"); err != ErrorLanguageNotFound {
+		t.Fatalf("expected %v; got %v", ErrorLanguageNotFound, err)
+	}
+	// Invalidation.
+	chtime(time.Now())
+	if lcs, err := cache.List(dir); err != nil || len(lcs) != 2 {
+		t.Fatalf("expected %d language configurations; got %v, %v", 2, lcs, err)
+	}
+	if lc, err := cache.Find(dir, "Latin"); err != nil || lc.Language != "latin" {
+		t.Fatalf("expected %s; got %v, %v", "latin", lc, err)
+	}
+	if _, err := cache.List(filepath.Join(dir, "no-such-backend")); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestListLanguagesContext(t *testing.T) {
+	lcs, err := ListLanguagesContext(context.Background(), "testdata")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if got := len(lcs); got != 4 {
+		t.Fatalf("expected %d language configurations; got %d", 4, got)
+	}
+	lc, err := FindLanguageContext(context.Background(), "testdata", "Latin")
+	if want := (LanguageConfiguration{"latin", "testdata/latin.ini"}); err != nil || lc != want {
+		t.Fatalf("exepected %v; got %v, %v", want, lc, err)
+	}
+}
+
+func TestListLanguagesContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ListLanguagesContext(ctx, "testdata"); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	if _, err := FindLanguageContext(ctx, "testdata", "german"); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+}
+
+func TestTokenValidate(t *testing.T) {
+	tests := []struct {
+		token Token
+		field string
+	}{
+		{Token{LE: "Lexicon"}, ""},
+		{Token{OCR: "Waſſer", COR: "Wasser"}, ""},
+		{Token{LE: "Lexi con"}, "LE"},
+		{Token{OCR: "Waſ\tſer"}, "OCR"},
+		{Token{OCR: "Waſſer", COR: "Was\u00a0ser"}, "COR"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.token.String(), func(t *testing.T) {
+			err := tc.token.Validate()
+			if tc.field == "" {
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), " "+tc.field+" ") {
+				t.Fatalf("expected an error for %s; got %v", tc.field, err)
+			}
+		})
+	}
+}
+
+func TestRunInvalidToken(t *testing.T) {
+	var l cmdLogger
+	p := Profiler{Exe: "testdata/run_profiler.bash", Log: &l}
+	_, err := p.Run(context.Background(), []Token{{OCR: "ok"}, {OCR: "not\tok"}})
+	if err == nil || !strings.Contains(err.Error(), "token 1") {
+		t.Fatalf("expected an error for token %d; got %v", 1, err)
+	}
+	if l.cmd != "" {
+		t.Fatalf("expected the profiler not to run; got %q", l.cmd)
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	tests := []Token{
+		{LE: "Lexicon"},
+		{OCR: "Waſſer"},
+		{OCR: "Waſſer", COR: "Wasser"},
+	}
+	for _, tc := range append(tests, tokens...) {
+		t.Run(tc.String(), func(t *testing.T) {
+			got, err := ParseToken(tc.String())
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got != tc {
+				t.Fatalf("expected %v; got %v", tc, got)
+			}
+		})
+	}
+	for _, line := range []string{"", "#", "#LE entry", "OCR ", " COR", "OCR COR x", "OCR\tCOR"} {
+		t.Run(line, func(t *testing.T) {
+			if _, err := ParseToken(line); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestListLanguagesTarGz(t *testing.T) {
+	lcs, err := ListLanguagesTarGz("testdata/languages.tar.gz")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := map[string]string{
+		"german": "testdata/languages.tar.gz/backend/german.ini",
+		"latin":  "testdata/languages.tar.gz/backend/latin.ini",
+	}
+	if got := len(lcs); got != len(want) {
+		t.Fatalf("expected %d language configurations; got %d", len(want), got)
+	}
+	for _, lc := range lcs {
+		if want[lc.Language] != lc.Path {
+			t.Fatalf("expected %q; got %q", want[lc.Language], lc.Path)
+		}
+	}
+}
+
 type testLogger struct {
 	got   string
 	want  string
@@ -61,9 +280,20 @@ func (l *testLogger) Log(str string) {
 	l.got += str + ";"
 }
 
+// cmdLogger records the logged command line of a run.
+type cmdLogger struct {
+	cmd string
+}
+
+func (l *cmdLogger) Log(str string) {
+	if strings.HasPrefix(str, "cmd: ") {
+		l.cmd = str
+	}
+}
+
 var tokens = []Token{
-	{LE: "LE entry 1"},
-	{LE: "LE entry 2"},
+	{LE: "LE-entry-1"},
+	{LE: "LE-entry-2"},
 	{OCR: "OCR1", COR: "COR1"},
 	{OCR: "OCR2", COR: "COR2"},
 	{OCR: "OCR3"},
@@ -100,6 +330,73 @@ func TestRunTimeOut(t *testing.T) {
 	}
 }
 
+func TestRunTimeOutWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var l cmdLogger
+	var mu sync.Mutex
+	n := 0
+	p := Profiler{Exe: "testdata/run_profiler_no_input.bash", Log: &l}
+	// The preprocessing of the first token cancels the run.
+	p.Preprocess = func(t Token) Token {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		cancel()
+		return t
+	}
+	if _, err := p.Run(ctx, tokens); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	if l.cmd != "" {
+		t.Fatalf("expected the profiler not to run; got %q", l.cmd)
+	}
+	// The tokens are not read anymore after Run has returned.
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected %d preprocessed token; got %d", 1, n)
+	}
+}
+
+func TestRunTimeOutNoInput(t *testing.T) {
+	// The profiler never reads its input.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := Profiler{Exe: "testdata/run_profiler_no_input.bash"}
+	start := time.Now()
+	if _, err := p.Run(ctx, tokens); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected timed out run; took %v", d)
+	}
+}
+
+func TestRunSourceCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var l cmdLogger
+	p := Profiler{Exe: "testdata/run_profiler.bash", Log: &l}
+	src := readerFunc(func(b []byte) (int, error) {
+		cancel()
+		return copy(b, "Waſſer\n"), nil
+	})
+	if _, err := p.RunSource(ctx, src); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	if l.cmd != "" {
+		t.Fatalf("expected the profiler not to run; got %q", l.cmd)
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
 func TestRunFunc(t *testing.T) {
 	ctx := context.Background()
 	p := Profiler{Exe: "testdata/run_profiler_simple_output.bash"}
@@ -115,3 +412,1319 @@ func TestRunFunc(t *testing.T) {
 		t.Errorf("expected %d candidate; got %d", 114, n)
 	}
 }
+
+func TestRunFuncStopIteration(t *testing.T) {
+	ctx := context.Background()
+	p := Profiler{Exe: "testdata/run_profiler_simple_output.bash"}
+	n := 0
+	err := p.RunFunc(ctx, tokens, func(ocr string, cand Candidate) error {
+		n++
+		return ErrStopIteration
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected %d candidate; got %d", 1, n)
+	}
+}
+
+func TestRunFuncProgress(t *testing.T) {
+	var calls, done, total int
+	p := Profiler{
+		Exe: "testdata/run_profiler_simple_output.bash",
+		Progress: func(d, t int) {
+			calls++
+			done, total = d, t
+		},
+	}
+	toks := []Token{{LE: "LE-entry-1"}, {LE: "LE-entry-2", OCR: "lexicon"}, {OCR: "forbes"}, {OCR: "theyl"}, {OCR: "forbes"}}
+	err := p.RunFunc(context.Background(), toks, func(string, Candidate) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if calls != 2 || done != 2 || total != 2 {
+		t.Fatalf("expected %d calls with %d/%d; got %d calls with %d/%d", 2, 2, 2, calls, done, total)
+	}
+}
+
+func TestRunFuncParseError(t *testing.T) {
+	out, err := ioutil.TempFile("", "gofiler-*.txt")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.Remove(out.Name())
+	const bad = "theyl@theil:{teil+[(t:th,0)]}+ocr[(i:y,3)],voteWeight=0.5,levDistance=,dict=modern"
+	fmt.Fprintln(out, bad)
+	out.Close()
+	p := Profiler{Exe: "testdata/run_profiler_output.bash", Config: out.Name()}
+	err = p.RunFunc(context.Background(), tokens, func(string, Candidate) error {
+		return nil
+	})
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected *ParseError; got %T: %v", err, err)
+	}
+	if perr.Expr != bad || perr.Field != "levDistance" {
+		t.Fatalf("expected %s in %s; got %s in %s", "levDistance", bad, perr.Field, perr.Expr)
+	}
+}
+
+func TestBatchTokens(t *testing.T) {
+	tests := []struct {
+		size int
+		want []int
+	}{
+		{0, []int{6}},
+		{1, []int{1, 1, 1, 1, 1, 1}},
+		{4, []int{4, 2}},
+		{6, []int{6}},
+		{10, []int{6}},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%d", tc.size), func(t *testing.T) {
+			batches := BatchTokens(tokens, tc.size)
+			if len(batches) != len(tc.want) {
+				t.Fatalf("expected %d batches; got %d", len(tc.want), len(batches))
+			}
+			for i := range batches {
+				if got := len(batches[i]); got != tc.want[i] {
+					t.Fatalf("expected %d tokens; got %d", tc.want[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunBatched(t *testing.T) {
+	ctx := context.Background()
+	tokens := append(tokens, Token{OCR: "OCR1"}, Token{OCR: "OCR3"}, Token{OCR: "OCR1"})
+	p := Profiler{Exe: "testdata/run_profiler_count.bash"}
+	want, err := p.Run(ctx, tokens)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	got, err := p.RunBatched(ctx, tokens, 2)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d interpretations; got %d", len(want), len(got))
+	}
+	for ocr, i := range want {
+		if got[ocr].N != i.N {
+			t.Fatalf("expected N=%d for %q; got %d", i.N, ocr, got[ocr].N)
+		}
+	}
+}
+
+func TestRunConcurrent(t *testing.T) {
+	ctx := context.Background()
+	p := Profiler{Exe: "testdata/run_profiler_both.bash", Types: true}
+	const n = 8
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := p.Run(ctx, tokens)
+			errs <- err
+		}()
+		go func() {
+			errs <- p.RunFunc(ctx, tokens, func(string, Candidate) error {
+				return nil
+			})
+		}()
+	}
+	for i := 0; i < 2*n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+}
+
+func TestRunFuncBackpressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The stub writes the number of lines it has written so far
+	// into the config file.
+	count := filepath.Join(dir, "count")
+	p := Profiler{Exe: "testdata/run_profiler_backpressure.bash", Config: count, ReadBufferSize: 4096}
+	const max = 50
+	n := 0
+	err = p.RunFunc(context.Background(), tokens, func(string, Candidate) error {
+		time.Sleep(5 * time.Millisecond)
+		n++
+		if n == max {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	data, err := ioutil.ReadFile(count)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	written, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	// The pipe buffers at most 64KB and the reader 4KB; with lines
+	// of roughly 100 bytes the stub cannot be more than a thousand
+	// lines ahead.
+	if written > max+1000 {
+		t.Fatalf("expected at most %d written lines; got %d", max+1000, written)
+	}
+}
+
+func TestRunCorrections(t *testing.T) {
+	tests := []struct {
+		exe  string
+		want map[string]string
+	}{
+		{"testdata/run_profiler_corrections.bash", map[string]string{
+			"OCR1": "ocr1", "OCR2": "ocr2", "OCR3": "ocr3", "OCR4": "ocr4",
+		}},
+		{"testdata/run_profiler_no_corrections.bash", map[string]string{
+			"Vnheilfolles": "Unheilvolles", "Waſſer": "Waser",
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.exe, func(t *testing.T) {
+			p := Profiler{Exe: tc.exe}
+			got, err := p.RunCorrections(context.Background(), tokens)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+type countLogger struct {
+	mu   sync.Mutex
+	cmds int
+}
+
+func (l *countLogger) Log(str string) {
+	if strings.HasPrefix(str, "cmd: ") {
+		l.mu.Lock()
+		l.cmds++
+		l.mu.Unlock()
+	}
+}
+
+func TestRunCorrectionsFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		p    Profiler
+		ctx  context.Context
+		fail bool
+		cmds int
+	}{
+		{"unsupported", Profiler{Exe: "testdata/run_profiler_no_corrections.bash"}, context.Background(), false, 2},
+		{"exit", Profiler{Exe: "testdata/run_profiler_exit.bash", Config: "1"}, context.Background(), true, 1},
+		{"missing", Profiler{Exe: "testdata/no-such-profiler"}, context.Background(), true, 1},
+		{"canceled", Profiler{Exe: "testdata/run_profiler_no_corrections.bash"}, ctx, true, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var l countLogger
+			tc.p.Log = &l
+			_, err := tc.p.RunCorrections(tc.ctx, tokens)
+			if tc.fail != (err != nil) {
+				t.Fatalf("expected error=%t; got %v", tc.fail, err)
+			}
+			if l.cmds != tc.cmds {
+				t.Fatalf("expected %d runs; got %d", tc.cmds, l.cmds)
+			}
+		})
+	}
+}
+
+func TestRunCorrectionsBadOutput(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	if _, err := p.RunCorrections(context.Background(), tokens); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestRunFuncPartialOnTimeout(t *testing.T) {
+	tests := []struct {
+		partial bool
+		fail    bool
+	}{
+		{true, false},
+		{false, true},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%t", tc.partial), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			p := Profiler{Exe: "testdata/run_profiler_slow.bash", PartialOnTimeout: tc.partial}
+			n := 0
+			err := p.RunFunc(ctx, tokens, func(ocr string, cand Candidate) error {
+				n++
+				return nil
+			})
+			if tc.fail != (err != nil) {
+				t.Fatalf("expected error=%t; got %v", tc.fail, err)
+			}
+			if n == 0 || n >= 114 {
+				t.Fatalf("expected partial candidates; got %d", n)
+			}
+		})
+	}
+}
+
+func TestRunWithLexicon(t *testing.T) {
+	tests := []struct {
+		lexicon []string
+		want    int
+	}{
+		{nil, 0},
+		{[]string{"OCR1"}, 1},
+		{[]string{"OCR2", "OCR3"}, 0},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprint(tc.lexicon), func(t *testing.T) {
+			p := Profiler{Exe: "testdata/run_profiler_lexicon.bash"}
+			profile, err := p.RunWithLexicon(context.Background(), tc.lexicon, tokens)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got := len(profile["OCR1"].Candidates); got != tc.want {
+				t.Fatalf("expected %d candidates; got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunWithStats(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler_stats.bash"}
+	profile, stats, err := p.RunWithStats(context.Background(), tokens)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if got := len(profile); got != 4 {
+		t.Fatalf("expected %d interpretations; got %d", 4, got)
+	}
+	want := RunStats{Tokens: 6, KnownTokens: 2, UnknownTokens: 4, Duration: 0.5}
+	if stats != want {
+		t.Fatalf("expected %v; got %v", want, stats)
+	}
+}
+
+func TestRunPipe(t *testing.T) {
+	want, err := ioutil.ReadFile("testdata/profile.txt")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	p := Profiler{Exe: "testdata/run_profiler_simple_output.bash"}
+	var got bytes.Buffer
+	if err := p.RunPipe(context.Background(), tokens, &got); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Fatalf("expected %d bytes; got %d", len(want), got.Len())
+	}
+}
+
+func TestMissingTokens(t *testing.T) {
+	tokens := []Token{
+		{LE: "lexicon"},
+		{OCR: "Waſſer"},
+		{OCR: "dropped"},
+		{OCR: "Vnheilfolles", COR: "Unheilvolles"},
+		{OCR: "dropped"},
+		{OCR: "empty"},
+	}
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	profile, err := p.Run(context.Background(), tokens)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	got := profile.MissingTokens(tokens)
+	if want := []string{"dropped"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+}
+
+func TestRunAdditionalLexicon(t *testing.T) {
+	var l cmdLogger
+	p := Profiler{Exe: "testdata/run_profiler.bash", Lexicon: "testdata/profile.txt", Log: &l}
+	if _, err := p.Run(context.Background(), tokens); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if want := " --additionalLexicon testdata/profile.txt"; !strings.Contains(l.cmd, want) {
+		t.Fatalf("expected %q in %q", want, l.cmd)
+	}
+}
+
+func TestRunFlagStyle(t *testing.T) {
+	tests := []struct {
+		style FlagStyle
+		want  string
+	}{
+		{LongFlags, `--config config --sourceFormat EXT --sourceFile \S+ --jsonOutput \S+ --types`},
+		{ShortFlags, `-c config -f EXT -s \S+ -j \S+ -t`},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprint(tc.style), func(t *testing.T) {
+			var l cmdLogger
+			p := Profiler{Exe: "testdata/run_profiler.bash", Config: "config", Types: true, FlagStyle: tc.style, Log: &l}
+			if _, err := p.Run(context.Background(), tokens); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if strings.Contains(l.cmd, "/dev/") {
+				t.Fatalf("unexpected device file in %q", l.cmd)
+			}
+			if !regexp.MustCompile(` ` + tc.want + `$`).MatchString(l.cmd) {
+				t.Fatalf("expected %q in %q", tc.want, l.cmd)
+			}
+		})
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	var l cmdLogger
+	p := Profiler{
+		Exe:       "testdata/run_profiler.bash",
+		Types:     true,
+		FlagStyle: ShortFlags,
+		Args:      []string{"--nrOfCandidates", "5", "--cautious"},
+		Log:       &l,
+	}
+	if _, err := p.Run(context.Background(), tokens); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if want := " -t --nrOfCandidates 5 --cautious"; !strings.HasSuffix(l.cmd, want) {
+		t.Fatalf("expected %q in %q", want, l.cmd)
+	}
+}
+
+func TestRunMaxCandidates(t *testing.T) {
+	for _, n := range []int{0, 5} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			var l cmdLogger
+			p := Profiler{Exe: "testdata/run_profiler.bash", MaxCandidates: n, Log: &l}
+			if _, err := p.Run(context.Background(), tokens); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			flag := " --nrOfCandidates"
+			if got := strings.Contains(l.cmd, flag); got != (n > 0) {
+				t.Fatalf("expected %q in %q: %t", flag, l.cmd, n > 0)
+			}
+			if want := " --nrOfCandidates 5"; n > 0 && !strings.HasSuffix(l.cmd, want) {
+				t.Fatalf("expected %q in %q", want, l.cmd)
+			}
+		})
+	}
+}
+
+func TestRunMissingAdditionalLexicon(t *testing.T) {
+	var l cmdLogger
+	p := Profiler{Exe: "testdata/run_profiler.bash", Lexicon: "testdata/no-such-lexicon", Log: &l}
+	if _, err := p.Run(context.Background(), tokens); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if l.cmd != "" {
+		t.Fatalf("expected the profiler not to run; got %q", l.cmd)
+	}
+}
+
+func TestRunGzipOutput(t *testing.T) {
+	for _, gzip := range []bool{true, false} {
+		t.Run(fmt.Sprintf("%t", gzip), func(t *testing.T) {
+			ctx := context.Background()
+			p := Profiler{Exe: "testdata/run_profiler_gzip.bash", GzipOutput: gzip}
+			profile, err := p.Run(ctx, tokens)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got := len(profile); got != 4 {
+				t.Fatalf("expected %d interpretations; got %d", 4, got)
+			}
+			n := 0
+			err = p.RunFunc(ctx, tokens, func(string, Candidate) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if n != 114 {
+				t.Fatalf("expected %d candidates; got %d", 114, n)
+			}
+		})
+	}
+}
+
+func TestRunByID(t *testing.T) {
+	tokens := []Token{
+		{LE: "lexicon", ID: "t0000"},
+		{OCR: "Waſſer", ID: "t0001"},
+		{OCR: "Vnheilfolles", ID: "t0002"},
+		{OCR: "Waſſer", ID: "t0003"},
+		{OCR: "Waſſer"},
+		{OCR: "missing", ID: "t0004"},
+	}
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	profile, err := p.RunByID(context.Background(), tokens)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := map[string]string{
+		"t0001": "Waſſer",
+		"t0002": "Vnheilfolles",
+		"t0003": "Waſſer",
+	}
+	if len(profile) != len(want) {
+		t.Fatalf("expected %d interpretations; got %d", len(want), len(profile))
+	}
+	for id, ocr := range want {
+		if got := profile[id].OCR; got != ocr {
+			t.Fatalf("expected OCR=%q for %s; got %q", ocr, id, got)
+		}
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	tokens := []Token{
+		{OCR: "theyl"},
+		{LE: "lexicon"},
+		{OCR: "forbes"},
+	}
+	tests := []struct {
+		skip, want int
+	}{
+		{0, 114},
+		{1, 57},
+		{2, 57},
+		{3, 0},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%d", tc.skip), func(t *testing.T) {
+			p := Profiler{Exe: "testdata/run_profiler_simple_output.bash"}
+			n := 0
+			err := p.RunResume(context.Background(), tokens, tc.skip, func(string, Candidate) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if n != tc.want {
+				t.Fatalf("expected %d candidates; got %d", tc.want, n)
+			}
+		})
+	}
+}
+
+func TestRunResumeUnexpectedToken(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler_simple_output.bash"}
+	err := p.RunResume(context.Background(), []Token{{OCR: "forbes"}, {OCR: "theyl"}}, 0,
+		func(string, Candidate) error { return nil })
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestRunSentinel(t *testing.T) {
+	tests := []struct {
+		exe  string
+		want error
+	}{
+		{"testdata/run_profiler_count.bash", nil},
+		{"testdata/run_profiler_truncate.bash", ErrTruncatedOutput},
+	}
+	lower := func(t Token) Token {
+		t.OCR = strings.ToLower(t.OCR)
+		return t
+	}
+	for _, tc := range tests {
+		for _, preprocess := range []func(Token) Token{nil, lower} {
+			t.Run(fmt.Sprintf("%s/%t", tc.exe, preprocess != nil), func(t *testing.T) {
+				p := Profiler{Exe: tc.exe, Sentinel: "SENTINEL", Preprocess: preprocess}
+				profile, err := p.Run(context.Background(), tokens)
+				if err != tc.want {
+					t.Fatalf("expected error %v; got %v", tc.want, err)
+				}
+				if err != nil {
+					return
+				}
+				if _, ok := profile["SENTINEL"]; ok {
+					t.Fatalf("expected sentinel to be removed")
+				}
+				if got := len(profile); got != 4 {
+					t.Fatalf("expected %d interpretations; got %d", 4, got)
+				}
+			})
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	docs := map[string][]Token{
+		"a": tokens,
+		"b": {{OCR: "Waſſer"}},
+		"c": {{OCR: "Vnheilfolles"}, {OCR: "theyl"}},
+	}
+	profiles, err := p.RunBatch(context.Background(), docs)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if len(profiles) != len(docs) {
+		t.Fatalf("expected %d profiles; got %d", len(docs), len(profiles))
+	}
+	for key, profile := range profiles {
+		if len(profile) != 4 {
+			t.Fatalf("expected %d interpretations in %s; got %d", 4, key, len(profile))
+		}
+	}
+}
+
+func TestRunBatchError(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	docs := map[string][]Token{
+		"good": tokens,
+		"bad":  {{OCR: "Waſſer Vnheilfolles"}},
+	}
+	profiles, err := p.RunBatch(context.Background(), docs)
+	berr, ok := err.(BatchError)
+	if !ok {
+		t.Fatalf("expected BatchError; got %T: %v", err, err)
+	}
+	if len(berr) != 1 || berr["bad"] == nil {
+		t.Fatalf("expected an error for %s; got %v", "bad", berr)
+	}
+	if len(profiles) != 1 || profiles["good"] == nil {
+		t.Fatalf("expected a profile for %s; got %v", "good", profiles)
+	}
+}
+
+func TestRunBatchConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler-")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	running := filepath.Join(dir, "running")
+	if err := os.Mkdir(running, 0755); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	p := Profiler{Exe: "testdata/run_profiler_concurrency.bash", Config: running, Concurrency: 2}
+	docs := make(map[string][]Token)
+	for i := 0; i < 6; i++ {
+		docs[fmt.Sprint(i)] = tokens
+	}
+	if _, err := p.RunBatch(context.Background(), docs); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	log, err := ioutil.ReadFile(running + ".log")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	counts := strings.Fields(string(log))
+	if len(counts) != len(docs) {
+		t.Fatalf("expected %d runs; got %d", len(docs), len(counts))
+	}
+	for _, count := range counts {
+		if n, err := strconv.Atoi(count); err != nil || n > 2 {
+			t.Fatalf("expected at most %d running profilers; got %s", 2, count)
+		}
+	}
+}
+
+func TestRunBatchCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler-")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	p := Profiler{Exe: "testdata/run_profiler_concurrency.bash", Config: dir, Concurrency: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	docs := map[string][]Token{"a": tokens, "b": tokens, "c": tokens}
+	_, err = p.RunBatch(ctx, docs)
+	berr, ok := err.(BatchError)
+	if !ok {
+		t.Fatalf("expected BatchError; got %T: %v", err, err)
+	}
+	for key := range docs {
+		if berr[key] != context.Canceled {
+			t.Fatalf("expected %v for %s; got %v", context.Canceled, key, berr[key])
+		}
+	}
+	if _, err := os.Stat(dir + ".log"); !os.IsNotExist(err) {
+		t.Fatalf("expected no started profilers; got %v", err)
+	}
+}
+
+func TestRunMulti(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler_config.bash"}
+	configs := []string{"ok", "fail"}
+	ctx := context.Background()
+	_, err := p.RunMulti(ctx, configs, tokens, RunMultiOptions{})
+	var exit *ExitError
+	if !errors.As(err, &exit) {
+		t.Fatalf("expected *ExitError; got %T: %v", err, err)
+	}
+	if exit.Code != 1 || exit.Stderr != "cannot load configuration: fail" {
+		t.Fatalf("expected exit status %d: %s; got %v", 1, "cannot load configuration: fail", exit)
+	}
+	results, err := p.RunMulti(ctx, configs, tokens, RunMultiOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected %d results; got %d", 2, len(results))
+	}
+	if err := results["ok"].Err; err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if got := len(results["ok"].Profile); got != 4 {
+		t.Fatalf("expected %d interpretations; got %d", 4, got)
+	}
+	if results["fail"].Err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestRunConcurrentTiming(t *testing.T) {
+	var timing RunTiming
+	p := Profiler{Exe: "testdata/run_profiler.bash", Timing: &timing, Concurrency: 4}
+	var configs []string
+	docs := make(map[string][]Token)
+	for i := 0; i < 8; i++ {
+		configs = append(configs, fmt.Sprint(i))
+		docs[fmt.Sprint(i)] = tokens
+	}
+	if _, err := p.RunMulti(context.Background(), configs, tokens, RunMultiOptions{}); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if _, err := p.RunBatch(context.Background(), docs); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if timing != (RunTiming{}) {
+		t.Fatalf("expected no timings; got %+v", timing)
+	}
+}
+
+func TestRunReadBufferSize(t *testing.T) {
+	for _, size := range []int{0, 16, 1024} {
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			p := Profiler{Exe: "testdata/run_profiler_both.bash", ReadBufferSize: size}
+			profile, err := p.Run(context.Background(), tokens)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got := len(profile["Vnheilfolles"].Candidates); got != 41 {
+				t.Fatalf("expected %d candidates; got %d", 41, got)
+			}
+			n := 0
+			err = p.RunFunc(context.Background(), tokens, func(string, Candidate) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if n != 114 {
+				t.Fatalf("expected %d candidates; got %d", 114, n)
+			}
+		})
+	}
+}
+
+func BenchmarkRunReadBufferSize(b *testing.B) {
+	// Write a large profile that is written by the stub.
+	var profile Profile
+	withOpenProfile(func(in io.Reader) {
+		if err := json.NewDecoder(in).Decode(&profile); err != nil {
+			b.Fatalf("got error: %v", err)
+		}
+	})
+	large := make(Profile)
+	for i := 0; i < 500; i++ {
+		for ocr, interpretation := range profile {
+			large[fmt.Sprintf("%s%d", ocr, i)] = interpretation
+		}
+	}
+	out, err := ioutil.TempFile("", "gofiler-*.json")
+	if err != nil {
+		b.Fatalf("got error: %v", err)
+	}
+	defer os.Remove(out.Name())
+	if err := json.NewEncoder(out).Encode(large); err != nil {
+		b.Fatalf("got error: %v", err)
+	}
+	out.Close()
+	for _, size := range []int{16, 4096, DefaultReadBufferSize} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			p := Profiler{Exe: "testdata/run_profiler_output.bash", Config: out.Name(), ReadBufferSize: size}
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Run(context.Background(), tokens); err != nil {
+					b.Fatalf("got error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunNoModern(t *testing.T) {
+	for _, noModern := range []bool{true, false} {
+		t.Run(fmt.Sprintf("%t", noModern), func(t *testing.T) {
+			var l cmdLogger
+			p := Profiler{Exe: "testdata/run_profiler_no_modern.bash", NoModern: noModern, Log: &l}
+			n, modern := 0, 0
+			err := p.RunFunc(context.Background(), tokens, func(ocr string, cand Candidate) error {
+				n++
+				if cand.Modern != "" {
+					modern++
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got := strings.Contains(l.cmd, " --noModern"); got != noModern {
+				t.Fatalf("expected --noModern=%t in %q", noModern, l.cmd)
+			}
+			if n != 114 {
+				t.Fatalf("expected %d candidates; got %d", 114, n)
+			}
+			if noModern && modern != 0 {
+				t.Fatalf("expected no modern forms; got %d", modern)
+			}
+			if !noModern && modern != n {
+				t.Fatalf("expected %d modern forms; got %d", n, modern)
+			}
+		})
+	}
+}
+
+func TestReadTokensNDJSON(t *testing.T) {
+	const ndjson = `{"le":"Lexicon"}
+{"ocr":"Waſſer","cor":"Wasser"}
+{"ocr":"Vnheilfolles"}
+`
+	got, err := ReadTokensNDJSON(strings.NewReader(ndjson))
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := []Token{
+		{LE: "Lexicon"},
+		{OCR: "Waſſer", COR: "Wasser"},
+		{OCR: "Vnheilfolles"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+}
+
+func TestReadTokensNDJSONWhitespace(t *testing.T) {
+	for _, test := range []string{
+		`{"ocr":"Waſ ſer"}`,
+		`{"ocr":"Waſſer","cor":"Was\tser"}`,
+		`{"ocr":"Waſſer"} {"ocr":`,
+	} {
+		t.Run(test, func(t *testing.T) {
+			if _, err := ReadTokensNDJSON(strings.NewReader(test)); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestRunTokensNDJSON(t *testing.T) {
+	const ndjson = `{"ocr":"a"}
+{"ocr":"b","cor":"c"}
+{"ocr":"a"}
+`
+	p := Profiler{Exe: "testdata/run_profiler_count.bash"}
+	profile, err := p.RunTokensNDJSON(context.Background(), strings.NewReader(ndjson))
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if len(profile) != 2 || profile["a"].N != 2 || profile["b"].N != 1 {
+		t.Fatalf("bad profile: %v", profile)
+	}
+}
+
+func TestRunTiming(t *testing.T) {
+	var timing RunTiming
+	p := Profiler{Exe: "testdata/run_profiler.bash", Timing: &timing}
+	if _, err := p.Run(context.Background(), tokens); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if timing.StartDuration <= 0 || timing.WriteDuration <= 0 || timing.ReadDuration <= 0 {
+		t.Fatalf("expected positive durations; got %+v", timing)
+	}
+	// The stub writes its output after reading all tokens.
+	if timing.ReadDuration < timing.WriteDuration {
+		t.Fatalf("expected read duration >= write duration; got %+v", timing)
+	}
+}
+
+func TestRunCancelRemovesTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofiler")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tmpdir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", tmpdir)
+
+	p := Profiler{Exe: "testdata/run_profiler_sleep.bash"}
+	tests := []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{"RunWithStats", func(ctx context.Context) error {
+			_, _, err := p.RunWithStats(ctx, tokens)
+			return err
+		}},
+		{"Run", func(ctx context.Context) error {
+			_, err := p.Run(ctx, tokens)
+			return err
+		}},
+		{"RunFunc", func(ctx context.Context) error {
+			return p.RunFunc(ctx, tokens, func(string, Candidate) error { return nil })
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				cancel()
+			}()
+			start := time.Now()
+			if err := tc.run(ctx); err == nil {
+				t.Fatalf("expected an error")
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Fatalf("expected cancelled run; took %v", d)
+			}
+			fis, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if len(fis) != 0 {
+				t.Fatalf("expected no temporary files; got %d", len(fis))
+			}
+		})
+	}
+}
+
+func TestRunPreprocess(t *testing.T) {
+	ligatures := strings.NewReplacer("ﬁ", "fi", "ﬀ", "ff", "ﬅ", "ſt")
+	p := Profiler{
+		Exe: "testdata/run_profiler_count.bash",
+		Preprocess: func(t Token) Token {
+			t.OCR = ligatures.Replace(t.OCR)
+			return t
+		},
+	}
+	tokens := []Token{
+		{OCR: "ﬁſch", ID: "t1"},
+		{OCR: "fiſch", ID: "t2"},
+		{OCR: "Schiﬀ", ID: "t3"},
+		{OCR: "Faſt"},
+	}
+	profile, err := p.Run(context.Background(), tokens)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := map[string]int{"fiſch": 2, "Schiff": 1, "Faſt": 1}
+	if len(profile) != len(want) {
+		t.Fatalf("expected %d interpretations; got %d", len(want), len(profile))
+	}
+	for ocr, n := range want {
+		if got := profile[ocr].N; got != n {
+			t.Fatalf("expected N=%d for %q; got %d", n, ocr, got)
+		}
+	}
+	byID, err := p.RunByID(context.Background(), tokens)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if got := byID["t1"].OCR; got != "fiſch" {
+		t.Fatalf("expected %q; got %q", "fiſch", got)
+	}
+}
+
+func TestRunMinPatternProb(t *testing.T) {
+	tests := []struct {
+		min        float64
+		hist, ocrs int
+	}{
+		{0, 3, 5},
+		{0.15, 1, 2},
+		{0.3, 1, 0},
+		{0.35, 0, 0},
+	}
+	runs := map[string]func(*Profiler) (Profile, error){
+		"Run": func(p *Profiler) (Profile, error) {
+			return p.Run(context.Background(), tokens)
+		},
+		"RunWithStats": func(p *Profiler) (Profile, error) {
+			profile, _, err := p.RunWithStats(context.Background(), tokens)
+			return profile, err
+		},
+		"RunObserve": func(p *Profiler) (Profile, error) {
+			return p.RunObserve(context.Background(), tokens, func(Interpretation) {})
+		},
+		"RunStream": func(p *Profiler) (Profile, error) {
+			profile := make(Profile)
+			err := p.RunStream(context.Background(), tokens, func(ocr string, i Interpretation) error {
+				profile[ocr] = i
+				return nil
+			})
+			return profile, err
+		},
+	}
+	for _, tc := range tests {
+		for name, run := range runs {
+			t.Run(fmt.Sprintf("%s/%g", name, tc.min), func(t *testing.T) {
+				p := Profiler{Exe: "testdata/run_profiler_stats.bash", MinPatternProb: tc.min}
+				profile, err := run(&p)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				hist, ocrs := 0, 0
+				for _, c := range profile["Vnheilfolles"].Candidates[:3] {
+					for _, pat := range c.HistPatterns {
+						if pat.Prob < tc.min {
+							t.Fatalf("unexpected pattern %v", pat)
+						}
+						hist++
+					}
+					for _, pat := range c.OCRPatterns {
+						if pat.Prob < tc.min {
+							t.Fatalf("unexpected pattern %v", pat)
+						}
+						ocrs++
+					}
+				}
+				if hist != tc.hist || ocrs != tc.ocrs {
+					t.Fatalf("expected %d/%d patterns; got %d/%d", tc.hist, tc.ocrs, hist, ocrs)
+				}
+			})
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	pairs := []Token{
+		{LE: "lexicon"},
+		{OCR: "Vnheilfolles", COR: "Unheilvolles"},
+		{OCR: "Waſſer", COR: "Wasser"},
+	}
+	var log levelLogger
+	p := Profiler{Exe: "testdata/run_profiler.bash", Log: &log}
+	res, err := p.Evaluate(context.Background(), pairs, 0)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if len(log.lines) != len(pairs) {
+		t.Fatalf("expected %d input lines; got %v", len(pairs), log.lines)
+	}
+	for _, line := range log.lines {
+		if strings.Contains(line, " ") {
+			t.Fatalf("expected no corrections in the input; got %q", line)
+		}
+	}
+	if res.Accuracy != 0.5 {
+		t.Fatalf("expected accuracy %g; got %g", 0.5, res.Accuracy)
+	}
+	want := []EvalMismatch{{Token: pairs[2], Got: "Waser"}}
+	if fmt.Sprint(res.Mismatches) != fmt.Sprint(want) {
+		t.Fatalf("expected %v; got %v", want, res.Mismatches)
+	}
+}
+
+func TestRunObserve(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	n := 0
+	profile, err := p.RunObserve(context.Background(), tokens, func(i Interpretation) {
+		n++
+		for j := range i.Candidates {
+			i.Candidates[j].Suggestion = "modified"
+		}
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if n != len(profile) {
+		t.Fatalf("expected %d calls; got %d", len(profile), n)
+	}
+	for ocr, i := range profile {
+		for _, c := range i.Candidates {
+			if c.Suggestion == "modified" {
+				t.Fatalf("callback modified the profile: %s", ocr)
+			}
+		}
+	}
+}
+
+func TestRunWithProvenance(t *testing.T) {
+	tokens := []Token{
+		{LE: "lexicon", Page: 1, Line: 1},
+		{OCR: "Waſſer", Page: 1, Line: 2},
+		{OCR: "Vnheilfolles", Page: 1, Line: 3},
+		{OCR: "Waſſer", Page: 2, Line: 1},
+		{OCR: "unknown", Page: 2, Line: 2},
+	}
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	profile, err := p.RunWithProvenance(context.Background(), tokens)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	tests := []struct {
+		ocr  string
+		want []Provenance
+	}{
+		{"Waſſer", []Provenance{{1, 2}, {2, 1}}},
+		{"Vnheilfolles", []Provenance{{1, 3}}},
+		{"empty", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ocr, func(t *testing.T) {
+			i, ok := profile[tc.ocr]
+			if !ok {
+				t.Fatalf("cannot find %q", tc.ocr)
+			}
+			if fmt.Sprint(i.Provenance) != fmt.Sprint(tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, i.Provenance)
+			}
+		})
+	}
+	if _, ok := profile["unknown"]; ok {
+		t.Fatalf("unexpected token %q", "unknown")
+	}
+}
+
+func TestRunStream(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler.bash"}
+	seen := make(map[string]bool)
+	err := p.RunStream(context.Background(), tokens, func(ocr string, i Interpretation) error {
+		seen[ocr] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if got := len(seen); got != 4 {
+		t.Fatalf("expected %d interpretations; got %d", 4, got)
+	}
+	n := 0
+	err = p.RunStream(context.Background(), tokens, func(string, Interpretation) error {
+		n++
+		return ErrStopIteration
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("expected %d interpretation; got %d, %v", 1, n, err)
+	}
+	stop := errors.New("stop")
+	err = p.RunStream(context.Background(), tokens, func(string, Interpretation) error {
+		return stop
+	})
+	if err == nil || !strings.Contains(err.Error(), stop.Error()) {
+		t.Fatalf("expected %v; got %v", stop, err)
+	}
+}
+
+func TestRunSource(t *testing.T) {
+	tests := []struct {
+		format, want string
+	}{
+		{"", "--sourceFormat EXT"},
+		{"TXT", "--sourceFormat TXT"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.want, func(t *testing.T) {
+			var l cmdLogger
+			p := Profiler{Exe: "testdata/run_profiler_count.bash", SourceFormat: tc.format, Log: &l}
+			profile, err := p.RunSource(context.Background(), strings.NewReader("a\nb\na\n"))
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !strings.Contains(l.cmd, " "+tc.want+" ") {
+				t.Fatalf("expected %q in %q", tc.want, l.cmd)
+			}
+			if got := profile["a"].N; got != 2 {
+				t.Fatalf("expected %d; got %d", 2, got)
+			}
+			if _, err := p.Run(context.Background(), tokens); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if want := " --sourceFormat EXT "; !strings.Contains(l.cmd, want) {
+				t.Fatalf("expected %q in %q", want, l.cmd)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		exe  string
+		fail bool
+	}{
+		{"testdata/run_profiler.bash", false},
+		{"testdata/run_profiler_config.bash", false},
+		{"testdata/no-such-profiler", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.exe, func(t *testing.T) {
+			p := Profiler{Exe: tc.exe}
+			if err := p.Check(context.Background()); (err != nil) != tc.fail {
+				t.Fatalf("expected error: %t; got %v", tc.fail, err)
+			}
+		})
+	}
+}
+
+func TestCheckTimeOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p := Profiler{Exe: "testdata/run_profiler_sleep.bash"}
+	if err := p.Check(ctx); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	for _, exe := range []string{
+		"testdata/run_profiler_version.bash",
+		"testdata/run_profiler_version_stderr.bash",
+	} {
+		t.Run(exe, func(t *testing.T) {
+			p := Profiler{Exe: exe}
+			version, err := p.Version(context.Background())
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if want := "profiler 1.2.3"; version != want {
+				t.Fatalf("expected %q; got %q", want, version)
+			}
+		})
+	}
+	p := Profiler{Exe: "testdata/no-such-profiler"}
+	if _, err := p.Version(context.Background()); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+// levelLogger records the logged lines with their severities.
+type levelLogger struct {
+	lines []string
+}
+
+func (l *levelLogger) Log(str string) {
+	if !strings.HasPrefix(str, "cmd: ") {
+		l.lines = append(l.lines, str)
+	}
+}
+
+func (l *levelLogger) Logf(level Level, str string) {
+	l.lines = append(l.lines, level.String()+": "+str)
+}
+
+func TestRunLeveledLogger(t *testing.T) {
+	var l levelLogger
+	p := Profiler{Exe: "testdata/run_profiler_levels.bash", Log: &l}
+	if _, err := p.Run(context.Background(), tokens); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := []string{
+		"info: loading configuration",
+		"no level",
+		"warning: unknown token",
+		"error: cannot load lexicon",
+	}
+	if fmt.Sprint(l.lines) != fmt.Sprint(want) {
+		t.Fatalf("expected %q; got %q", want, l.lines)
+	}
+	// Plain loggers get the lines unchanged.
+	var plain levelLogger
+	p.Log = struct{ Logger }{&plain}
+	if _, err := p.Run(context.Background(), tokens); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if want := "[warning] unknown token"; len(plain.lines) != 4 || plain.lines[2] != want {
+		t.Fatalf("expected %q; got %q", want, plain.lines)
+	}
+}
+
+func TestRunExitError(t *testing.T) {
+	for _, code := range []int{2, 3} {
+		t.Run(strconv.Itoa(code), func(t *testing.T) {
+			var l cmdLogger
+			p := Profiler{Exe: "testdata/run_profiler_exit.bash", Config: strconv.Itoa(code), Log: &l}
+			_, err := p.Run(context.Background(), tokens)
+			exit, ok := err.(*ExitError)
+			if !ok {
+				t.Fatalf("expected an *ExitError; got %v", err)
+			}
+			if exit.Code != code {
+				t.Fatalf("expected exit code %d; got %d", code, exit.Code)
+			}
+			if want := "starting\ncannot parse input"; exit.Stderr != want {
+				t.Fatalf("expected %q; got %q", want, exit.Stderr)
+			}
+			err = p.RunFunc(context.Background(), tokens, func(string, Candidate) error { return nil })
+			if exit, ok := err.(*ExitError); !ok || exit.Code != code {
+				t.Fatalf("expected exit code %d; got %v", code, err)
+			}
+		})
+	}
+}
+
+func TestRunStderrTail(t *testing.T) {
+	p := Profiler{Exe: "testdata/run_profiler_config.bash", Config: "fail"}
+	_, err := p.Run(context.Background(), tokens)
+	if want := "cannot load configuration: fail"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected %q in %v", want, err)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"abc"}, "abc"},
+		{[]string{"abcde"}, "abcde"},
+		{[]string{"abc", "de"}, "abcde"},
+		{[]string{"abc", "def"}, "bcdef"},
+		{[]string{"abcdefgh"}, "defgh"},
+		{[]string{"ab", "cd", "ef", "gh", "i"}, "efghi"},
+	}
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.writes, ","), func(t *testing.T) {
+			b := newTailBuffer(5)
+			for _, w := range tc.writes {
+				if n, err := b.Write([]byte(w)); err != nil || n != len(w) {
+					t.Fatalf("bad write: %d, %v", n, err)
+				}
+			}
+			if got := b.String(); got != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+# Sourced by the fake profilers.  Parses the profiler's arguments,
+# reads stdin from the source file and redirects stdout to the json
+# output file if one is given.
+parse_args() {
+	while [[ $# -gt 0 ]]; do
+		case "$1" in
+		--config|-c) config="$2"; shift;;
+		--sourceFile|-s) source="$2"; shift;;
+		--jsonOutput|-j) json="$2"; shift;;
+		--statsOutput|-S) stats="$2"; shift;;
+		esac
+		shift
+	done
+}
+parse_args "$@"
+if [[ -n "$source" ]]; then
+	exec < "$source"
+fi
+if [[ -n "$json" ]]; then
+	exec > "$json"
+fi
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+line=$(head -n 1 testdata/profile.txt)
+for ((i = 1; i <= 5000; i++)); do
+	echo "$line"
+	echo "$i" > "$config"
+done
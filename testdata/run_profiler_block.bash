@@ -1,5 +1,6 @@
 #!/bin/bash
 
+. testdata/profiler_args.bash
 cat > /dev/null
 while true; do
  	echo "blocking"
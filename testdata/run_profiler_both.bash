@@ -0,0 +1,11 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+for arg in "$@"; do
+	if [[ "$arg" == "--simpleOutput" ]]; then
+		cat testdata/profile.txt
+		exit 0
+	fi
+done
+cat testdata/profile.json
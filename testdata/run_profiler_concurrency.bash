@@ -0,0 +1,11 @@
+#!/bin/bash
+
+# Mark this process as running in the directory given as
+# configuration and log the number of running processes.
+. testdata/profiler_args.bash
+cat > /dev/null
+touch "$config/$$"
+ls "$config" | wc -l >> "$config.log"
+sleep 0.2
+rm "$config/$$"
+cat testdata/profile.json
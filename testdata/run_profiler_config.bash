@@ -0,0 +1,10 @@
+#!/bin/bash
+
+# Fail for the configuration `fail`.
+. testdata/profiler_args.bash
+cat > /dev/null
+if [[ "$config" == fail ]]; then
+	echo "cannot load configuration: $config" >&2
+	exit 1
+fi
+cat testdata/profile.json
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+while read ocr cor; do
+	case "$ocr" in
+	\#*) ;;
+	*) echo "$ocr -> $(echo "$ocr" | tr "[:upper:]" "[:lower:]")";;
+	esac
+done
@@ -0,0 +1,14 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+awk '
+!/^#/ { n[$1]++ }
+END {
+	printf "{"
+	sep = ""
+	for (ocr in n) {
+		printf "%s\"%s\":{\"OCR\":\"%s\",\"N\":%d,\"Candidates\":[]}", sep, ocr, ocr, n[ocr]
+		sep = ","
+	}
+	print "}"
+}'
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+# Fail with the exit code given as configuration.
+. testdata/profiler_args.bash
+cat > /dev/null
+echo "starting" >&2
+echo "cannot parse input" >&2
+exit "$config"
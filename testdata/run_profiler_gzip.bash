@@ -0,0 +1,17 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+output=testdata/profile.json
+gzip=false
+for arg in "$@"; do
+	case "$arg" in
+	--simpleOutput) output=testdata/profile.txt;;
+	--gzipOutput) gzip=true;;
+	esac
+done
+if [[ $gzip == true ]]; then
+	gzip -c $output
+else
+	cat $output
+fi
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+echo "[info] loading configuration" >&2
+echo "no level" >&2
+echo "[warning] unknown token" >&2
+echo "[error] cannot load lexicon" >&2
+cat testdata/profile.json
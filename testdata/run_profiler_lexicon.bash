@@ -0,0 +1,20 @@
+#!/bin/bash
+
+# Lexicon entries (#entry) produce a candidate for equal OCR tokens.
+. testdata/profiler_args.bash
+awk '
+/^#/ { lex[substr($1, 2)] = 1; next }
+{ ocr[$1] = 1 }
+END {
+	printf "{"
+	sep = ""
+	for (o in ocr) {
+		cands = ""
+		if (o in lex) {
+			cands = sprintf("{\"Suggestion\":\"%s\",\"Modern\":\"%s\",\"Dict\":\"lexicon\",\"Distance\":0,\"Weight\":1}", o, o)
+		}
+		printf "%s\"%s\":{\"OCR\":\"%s\",\"N\":1,\"Candidates\":[%s]}", sep, o, o, cands
+		sep = ","
+	}
+	print "}"
+}'
@@ -0,0 +1,11 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+for arg in "$@"; do
+	if [[ "$arg" == "--correctionList" ]]; then
+		echo "unknown option: $arg" >&2
+		exit 1
+	fi
+done
+cat testdata/profile.json
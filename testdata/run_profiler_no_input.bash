@@ -0,0 +1,4 @@
+#!/bin/bash
+
+# Never read the input tokens.
+exec sleep 10
@@ -0,0 +1,11 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+for arg in "$@"; do
+	if [[ "$arg" == "--noModern" ]]; then
+		sed -e 's/:{[^+]*+\[/:{+[/' testdata/profile.txt
+		exit 0
+	fi
+done
+cat testdata/profile.txt
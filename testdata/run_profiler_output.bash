@@ -0,0 +1,6 @@
+#!/bin/bash
+
+# Write the file given as configuration to stdout.
+. testdata/profiler_args.bash
+cat > /dev/null
+cat "$config"
@@ -1,5 +1,6 @@
 #!/bin/bash
 
+. testdata/profiler_args.bash
 while read line; do
 	echo "$line" >&2
 done
@@ -0,0 +1,5 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+exec sleep 10
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+cat > /dev/null
+while read line; do
+	echo "$line"
+	sleep 0.01
+done < testdata/profile.txt
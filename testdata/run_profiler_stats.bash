@@ -0,0 +1,9 @@
+#!/bin/bash
+
+. testdata/profiler_args.bash
+n=0
+while read line; do
+	n=$((n+1))
+done
+echo "{\"Tokens\":$n,\"KnownTokens\":2,\"UnknownTokens\":$((n-2)),\"Duration\":0.5}" > "$stats"
+cat testdata/profile.json
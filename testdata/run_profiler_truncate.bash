@@ -0,0 +1,5 @@
+#!/bin/bash
+
+# Drop the last input token.
+. testdata/profiler_args.bash
+sed '$d' | testdata/run_profiler_count.bash
@@ -0,0 +1,7 @@
+#!/bin/bash
+
+if [[ "$1" == "--version" ]]; then
+	echo "  profiler 1.2.3 "
+	exit 0
+fi
+exit 1
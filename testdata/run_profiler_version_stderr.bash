@@ -0,0 +1,8 @@
+#!/bin/bash
+
+# Write the version to stderr.
+if [[ "$1" == "--version" ]]; then
+	echo "profiler 1.2.3" >&2
+	exit 0
+fi
+exit 1